@@ -0,0 +1,74 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+// AdminHandler serves routes only admins may use.
+type AdminHandler struct {
+	loginAttemptStore store.LoginAttemptStore
+}
+
+func NewAdminHandler(loginAttemptStore store.LoginAttemptStore) *AdminHandler {
+	return &AdminHandler{
+		loginAttemptStore: loginAttemptStore,
+	}
+}
+
+type unlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+func (h *AdminHandler) HandleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := h.loginAttemptStore.GetLockouts(r.Context())
+	if err != nil {
+		utils.WriteServerError(w, r, "getLockouts", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"lockouts": lockouts})
+}
+
+// HandleUnlock clears the failed logins of a username or an IP address,
+// lifting its lockout.
+func (h *AdminHandler) HandleUnlock(w http.ResponseWriter, r *http.Request) {
+	var req unlockRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingUnlock", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if (req.Username == "") == (req.IP == "") {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "provide either username or ip"})
+		return
+	}
+
+	key := UsernameLoginKey(req.Username)
+	if req.IP != "" {
+		key = IPLoginKey(req.IP)
+	}
+
+	err = h.loginAttemptStore.ResetAttempts(r.Context(), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "no failed logins recorded for " + key})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "resetAttempts", err, "failed to unlock")
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("admin removed lockout", "key", key)
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"lockout": "removed successfully"})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+// listAccess decides what the current user may do with a list. List handlers
+// go through it rather than comparing owner ids themselves.
+type listAccess struct {
+	listStore store.ListStore
+}
+
+// readListRole reads the list id from the route and looks up the role the
+// current user holds on that list, which is empty for non-members. It writes
+// the error response itself and returns false when the request should not
+// continue.
+func (a listAccess) readListRole(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+	listID, err := utils.ReadIDParam(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid list id"})
+		return 0, "", false
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	role, err := a.listStore.GetListRole(r.Context(), listID, currentUser.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
+			return 0, "", false
+		}
+
+		utils.WriteServerError(w, r, "getListRole", err, "internal server error")
+		return 0, "", false
+	}
+
+	return listID, role, true
+}
+
+// authorize is readListRole followed by a check that the current user holds
+// at least the required role.
+func (a listAccess) authorize(w http.ResponseWriter, r *http.Request, required string) (int64, bool) {
+	listID, role, ok := a.readListRole(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	if !store.RoleAllows(role, required) {
+		a.forbidden(w)
+		return 0, false
+	}
+
+	return listID, true
+}
+
+func (a listAccess) forbidden(w http.ResponseWriter) {
+	utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to perform this action on this list"})
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+type ListEntryHandler struct {
+	listStore store.ListStore
+	access    listAccess
+}
+
+func NewListEntryHandler(listStore store.ListStore) *ListEntryHandler {
+	return &ListEntryHandler{
+		listStore: listStore,
+		access:    listAccess{listStore: listStore},
+	}
+}
+
+type createListEntryRequest struct {
+	Title      string     `json:"title"`
+	OrderIndex *int       `json:"order_index"`
+	Completed  bool       `json:"completed"`
+	DueAt      *time.Time `json:"due_at"`
+	Priority   int        `json:"priority"`
+	Notes      string     `json:"notes"`
+}
+
+type updateListEntryRequest struct {
+	Title      *string      `json:"title"`
+	OrderIndex *int         `json:"order_index"`
+	Completed  *bool        `json:"completed"`
+	DueAt      nullableTime `json:"due_at"`
+	Priority   *int         `json:"priority"`
+	Notes      *string      `json:"notes"`
+}
+
+// nullableTime distinguishes a field that was omitted from one explicitly set
+// to null, so PATCH requests can clear a due date.
+type nullableTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (n *nullableTime) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+
+	var t time.Time
+	err := json.Unmarshal(data, &t)
+	if err != nil {
+		return err
+	}
+
+	n.Value = &t
+	return nil
+}
+
+func validPriority(priority int) bool {
+	return priority >= store.PriorityNone && priority <= store.PriorityHigh
+}
+
+type reorderListEntriesRequest struct {
+	EntryIDs []int64 `json:"entry_ids"`
+	Move     *struct {
+		EntryID int64  `json:"entry_id"`
+		Before  *int64 `json:"before"`
+		After   *int64 `json:"after"`
+	} `json:"move"`
+}
+
+func (h *ListEntryHandler) readEntryID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	entryID, err := utils.ReadNamedIDParam(r, "entryID")
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readEntryIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid entry id"})
+		return 0, false
+	}
+
+	return entryID, true
+}
+
+func (h *ListEntryHandler) HandleCreateListEntry(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var req createListEntryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingCreateListEntry", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Title == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title is required"})
+		return
+	}
+
+	if !validPriority(req.Priority) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "priority must be between 0 and 3"})
+		return
+	}
+
+	// Entries without an explicit position are appended to the list.
+	entry := &store.ListEntry{
+		Title:      req.Title,
+		OrderIndex: -1,
+		Completed:  req.Completed,
+		DueAt:      req.DueAt,
+		Priority:   req.Priority,
+		Notes:      req.Notes,
+	}
+
+	if req.OrderIndex != nil {
+		entry.OrderIndex = *req.OrderIndex
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.listStore.CreateListEntry(r.Context(), listID, entry, currentUser.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "createListEntry", err, "failed to create entry")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"entry": entry})
+}
+
+func (h *ListEntryHandler) HandleGetListEntry(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RolePublic)
+	if !ok {
+		return
+	}
+
+	entryID, ok := h.readEntryID(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err := h.listStore.GetListEntry(r.Context(), listID, entryID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListEntry", err, "internal server error")
+		return
+	}
+
+	if entry == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "entry not found"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"entry": entry})
+}
+
+func (h *ListEntryHandler) HandleUpdateListEntry(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleEditor)
+	if !ok {
+		return
+	}
+
+	entryID, ok := h.readEntryID(w, r)
+	if !ok {
+		return
+	}
+
+	var req updateListEntryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingUpdateListEntry", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	entry, err := h.listStore.GetListEntry(r.Context(), listID, entryID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListEntry", err, "internal server error")
+		return
+	}
+
+	if entry == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "entry not found"})
+		return
+	}
+
+	if req.Title != nil {
+		if *req.Title == "" {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title cannot be empty"})
+			return
+		}
+		entry.Title = *req.Title
+	}
+
+	if req.OrderIndex != nil {
+		entry.OrderIndex = *req.OrderIndex
+	}
+
+	if req.Completed != nil {
+		entry.Completed = *req.Completed
+	}
+
+	if req.DueAt.Set {
+		entry.DueAt = req.DueAt.Value
+	}
+
+	if req.Priority != nil {
+		if !validPriority(*req.Priority) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "priority must be between 0 and 3"})
+			return
+		}
+		entry.Priority = *req.Priority
+	}
+
+	if req.Notes != nil {
+		entry.Notes = *req.Notes
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.listStore.UpdateListEntry(r.Context(), listID, entry, currentUser.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "entry not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "updateListEntry", err, "failed to update entry")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"entry": entry})
+}
+
+func (h *ListEntryHandler) HandleDeleteListEntry(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleEditor)
+	if !ok {
+		return
+	}
+
+	entryID, ok := h.readEntryID(w, r)
+	if !ok {
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err := h.listStore.DeleteListEntry(r.Context(), listID, entryID, currentUser.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "entry not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "deleteListEntry", err, "failed to delete entry")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"entry": "deleted successfully"})
+}
+
+func (h *ListEntryHandler) HandleReorderListEntries(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var req reorderListEntriesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingReorderListEntries", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if (req.EntryIDs == nil) == (req.Move == nil) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "provide either entry_ids or move"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	var entries []store.ListEntry
+	if req.EntryIDs != nil {
+		entries, err = h.listStore.ReorderListEntries(r.Context(), listID, req.EntryIDs, currentUser.ID)
+	} else {
+		if (req.Move.Before == nil) == (req.Move.After == nil) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "move requires exactly one of before or after"})
+			return
+		}
+
+		anchorID, after := req.Move.Before, false
+		if req.Move.After != nil {
+			anchorID, after = req.Move.After, true
+		}
+
+		entries, err = h.listStore.MoveListEntry(r.Context(), listID, req.Move.EntryID, *anchorID, after, currentUser.ID)
+	}
+
+	if errors.Is(err, store.ErrInvalidEntryOrder) {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "entry not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "reorderListEntries", err, "failed to reorder entries")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"entries": entries})
+}
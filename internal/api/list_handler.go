@@ -4,9 +4,16 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/mikemcavoydev/list-api/internal/jsonpatch"
+	"github.com/mikemcavoydev/list-api/internal/logging"
 	"github.com/mikemcavoydev/list-api/internal/middleware"
 	"github.com/mikemcavoydev/list-api/internal/store"
 	"github.com/mikemcavoydev/list-api/internal/utils"
@@ -14,33 +21,151 @@ import (
 
 type ListHandler struct {
 	listStore store.ListStore
-	logger    *log.Logger
+	access    listAccess
+
+	// RequireIfMatch rejects writes to a list that do not send an If-Match
+	// header with 428 Precondition Required.
+	RequireIfMatch bool
 }
 
-func NewListHandler(listStore store.ListStore, logger *log.Logger) *ListHandler {
+func NewListHandler(listStore store.ListStore) *ListHandler {
 	return &ListHandler{
 		listStore: listStore,
-		logger:    logger,
+		access:    listAccess{listStore: listStore},
 	}
 }
 
 func (h *ListHandler) HandleGetListById(w http.ResponseWriter, r *http.Request) {
-	listID, err := utils.ReadIDParam(r)
-	if err != nil {
-		h.logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid list id"})
+	listID, ok := h.access.authorize(w, r, store.RolePublic)
+	if !ok {
 		return
 	}
 
-	list, err := h.listStore.GetListByID(listID)
+	query := r.URL.Query()
+
+	var filter store.EntryFilter
+
+	if completed := query.Get("completed"); completed != "" {
+		value, err := strconv.ParseBool(completed)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "completed must be true or false"})
+			return
+		}
+		filter.Completed = &value
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		filter.Descending = strings.HasPrefix(sort, "-")
+		filter.Sort = strings.TrimPrefix(sort, "-")
+		if !store.ValidEntrySort(filter.Sort) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "sort must be one of order_index, due_at or priority"})
+			return
+		}
+	}
+
+	list, err := h.listStore.GetFilteredListByID(r.Context(), listID, filter)
 	if err != nil {
-		h.logger.Printf("ERROR: getListByID: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		utils.WriteServerError(w, r, "getListByID", err, "internal server error")
 		return
 	}
 
 	if list == nil {
-		h.logger.Printf("ERROR: getListByID: %v", err)
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
+		return
+	}
+
+	etag := utils.ETag(list.Version)
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && utils.MatchesETag(match, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": list})
+}
+
+// checkIfMatch enforces the If-Match precondition of a write against the
+// list's current version. It writes the error response itself and returns
+// false when the request should not continue.
+func (h *ListHandler) checkIfMatch(w http.ResponseWriter, r *http.Request, list *store.List) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		if h.RequireIfMatch {
+			utils.WriteJSON(w, http.StatusPreconditionRequired, utils.Envelope{"error": "an If-Match header is required to modify this list"})
+			return false
+		}
+		return true
+	}
+
+	if !utils.MatchesETag(match, utils.ETag(list.Version), false) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": store.ErrEditConflict.Error()})
+		return false
+	}
+
+	return true
+}
+
+func (h *ListHandler) HandleGetLists(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	query := r.URL.Query()
+
+	filter := store.ListFilter{
+		Title:          query.Get("title"),
+		Sort:           "created_at",
+		Cursor:         query.Get("cursor"),
+		Limit:          20,
+		IncludeEntries: query.Get("include") == "entries",
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		filter.Descending = strings.HasPrefix(sort, "-")
+		filter.Sort = strings.TrimPrefix(sort, "-")
+		if !store.ValidListSort(filter.Sort) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "sort must be one of title, created_at or updated_at"})
+			return
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 100 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 100"})
+			return
+		}
+		filter.Limit = n
+	}
+
+	lists, nextCursor, err := h.listStore.GetListsForUser(r.Context(), currentUser.ID, filter)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidCursor) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+			return
+		}
+
+		utils.WriteServerError(w, r, "getListsForUser", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"lists":    lists,
+		"metadata": utils.Envelope{"next_cursor": nextCursor},
+	})
+}
+
+// HandleGetPublicList serves public and unlisted lists by their slug and does
+// not require the caller to be logged in.
+func (h *ListHandler) HandleGetPublicList(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+
+	list, err := h.listStore.GetListBySlug(r.Context(), slug)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListBySlug", err, "internal server error")
+		return
+	}
+
+	if list == nil || list.Visibility == store.VisibilityPrivate {
 		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
 		return
 	}
@@ -52,7 +177,7 @@ func (h *ListHandler) HandleCreateListById(w http.ResponseWriter, r *http.Reques
 	var list store.List
 	err := json.NewDecoder(r.Body).Decode(&list)
 	if err != nil {
-		h.logger.Printf("ERROR: decodingCreateList: %v", err)
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingCreateList", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request sent"})
 		return
 	}
@@ -63,48 +188,59 @@ func (h *ListHandler) HandleCreateListById(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if list.Visibility != "" && !store.ValidVisibility(list.Visibility) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "visibility must be one of private, unlisted or public"})
+		return
+	}
+
 	list.UserID = currentUser.ID
 
-	createdList, err := h.listStore.CreateList(&list)
+	createdList, err := h.listStore.CreateList(r.Context(), &list)
 	if err != nil {
-		h.logger.Printf("ERROR: createList: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create list"})
+		utils.WriteServerError(w, r, "createList", err, "failed to create list")
 		return
 	}
 
+	w.Header().Set("ETag", utils.ETag(createdList.Version))
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"list": createdList})
 }
 
 func (h *ListHandler) HandleUpdateListById(w http.ResponseWriter, r *http.Request) {
-	listID, err := utils.ReadIDParam(r)
-	if err != nil {
-		h.logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid list id"})
+	listID, role, ok := h.access.readListRole(w, r)
+	if !ok {
 		return
 	}
 
-	existingList, err := h.listStore.GetListByID(listID)
+	if !store.RoleAllows(role, store.RoleEditor) {
+		h.access.forbidden(w)
+		return
+	}
+
+	existingList, err := h.listStore.GetListByID(r.Context(), listID)
 	if err != nil {
-		h.logger.Printf("ERROR: getListById: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to fetch list"})
+		utils.WriteServerError(w, r, "getListById", err, "failed to fetch list")
 		return
 	}
 
 	if existingList == nil {
-		h.logger.Printf("ERROR: getListByID: %v", err)
 		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
 		return
 	}
 
+	if !h.checkIfMatch(w, r, existingList) {
+		return
+	}
+
 	var updateListRequest struct {
 		Title       *string           `json:"title"`
 		Description *string           `json:"description"`
 		Entries     []store.ListEntry `json:"entries"`
+		Visibility  *string           `json:"visibility"`
 	}
 
 	err = json.NewDecoder(r.Body).Decode(&updateListRequest)
 	if err != nil {
-		h.logger.Printf("ERROR: decodingUpdateRequest: %v", err)
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingUpdateRequest", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
@@ -121,80 +257,360 @@ func (h *ListHandler) HandleUpdateListById(w http.ResponseWriter, r *http.Reques
 		existingList.Entries = updateListRequest.Entries
 	}
 
+	if updateListRequest.Visibility != nil && *updateListRequest.Visibility != existingList.Visibility {
+		if !store.ValidVisibility(*updateListRequest.Visibility) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "visibility must be one of private, unlisted or public"})
+			return
+		}
+
+		// Sharing a list outside its members is an owner decision.
+		if !store.RoleAllows(role, store.RoleOwner) {
+			h.access.forbidden(w)
+			return
+		}
+
+		existingList.Visibility = *updateListRequest.Visibility
+	}
+
 	currentUser := middleware.GetUser(r)
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+
+	err = h.listStore.UpdateList(r.Context(), existingList, currentUser.ID)
+	if errors.Is(err, store.ErrEditConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": err.Error()})
 		return
 	}
 
-	listOwner, err := h.listStore.GetListOwner(listID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteServerError(w, r, "updatingList", err, "failed to update list")
+		return
+	}
+
+	w.Header().Set("ETag", utils.ETag(existingList.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": existingList})
+}
+
+func (h *ListHandler) HandleDeleteList(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleOwner)
+	if !ok {
+		return
+	}
+
+	// Without a precondition the list is deleted whatever its version. With
+	// one, the delete only applies to the version the header was checked
+	// against, so a write in between is not lost.
+	version := 0
+	if h.RequireIfMatch || r.Header.Get("If-Match") != "" {
+		list, err := h.listStore.GetListByID(r.Context(), listID)
+		if err != nil {
+			utils.WriteServerError(w, r, "getListByID", err, "internal server error")
+			return
+		}
+
+		if list == nil {
 			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
 			return
 		}
 
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		if !h.checkIfMatch(w, r, list) {
+			return
+		}
+
+		version = list.Version
+	}
+
+	err := h.listStore.DeleteList(r.Context(), listID, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
 		return
 	}
 
-	if listOwner != currentUser.ID {
-		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to update this list"})
+	if errors.Is(err, store.ErrEditConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": err.Error()})
 		return
 	}
 
-	err = h.listStore.UpdateList(existingList)
 	if err != nil {
-		h.logger.Printf("ERROR: updatingList: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update list"})
+		utils.WriteServerError(w, r, "deletingList", err, "failed to delete list")
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": existingList})
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"list": "deleted successfully"})
 }
 
-func (h *ListHandler) HandleDeleteList(w http.ResponseWriter, r *http.Request) {
+func (h *ListHandler) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	lists, err := h.listStore.GetTrashedLists(r.Context(), currentUser.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getTrashedLists", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"lists": lists})
+}
+
+func (h *ListHandler) HandleRestoreList(w http.ResponseWriter, r *http.Request) {
 	listID, err := utils.ReadIDParam(r)
 	if err != nil {
-		h.logger.Printf("ERROR: readIDParam: %v", err)
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readIDParam", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid list id"})
 		return
 	}
 
 	currentUser := middleware.GetUser(r)
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+
+	err = h.listStore.RestoreList(r.Context(), listID, currentUser.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found in trash"})
 		return
 	}
 
-	listOwner, err := h.listStore.GetListOwner(listID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
+		utils.WriteServerError(w, r, "restoreList", err, "failed to restore list")
+		return
+	}
+
+	list, err := h.listStore.GetListByID(r.Context(), listID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListByID", err, "internal server error")
+		return
+	}
+
+	// The list can be deleted again, or purged, right after the restore.
+	if list == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": list})
+}
+
+// listPatchDocument is the part of a list that PATCH requests operate on.
+// Entry order follows array position; an entry's id, order_index and
+// completed_at cannot be patched directly.
+type listPatchDocument struct {
+	Title       string            `json:"title"`
+	Description string            `json:"description"`
+	Visibility  string            `json:"visibility"`
+	Entries     []store.ListEntry `json:"entries"`
+}
+
+var readOnlyEntryFields = map[string]bool{
+	"id":           true,
+	"order_index":  true,
+	"completed_at": true,
+}
+
+// checkPatchPath rejects paths outside the patch document or pointing at
+// read-only entry fields.
+func checkPatchPath(pointer string) error {
+	path, err := jsonpatch.ParsePointer(pointer)
+	if err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		return nil
+	}
+
+	switch path[0] {
+	case "title", "description", "visibility":
+		if len(path) > 1 {
+			return fmt.Errorf("%s has no members", path[0])
+		}
+	case "entries":
+		if len(path) > 2 && readOnlyEntryFields[path[2]] {
+			return fmt.Errorf("%s cannot be changed", path[2])
+		}
+	default:
+		return fmt.Errorf("%q cannot be patched", path[0])
+	}
+
+	return nil
+}
+
+// validatePatchedList checks a patched document, keyed by the JSON pointer of
+// each invalid field.
+func validatePatchedList(doc *listPatchDocument) map[string]string {
+	errs := map[string]string{}
+
+	if doc.Title == "" {
+		errs["/title"] = "title is required"
+	}
+
+	if !store.ValidVisibility(doc.Visibility) {
+		errs["/visibility"] = "visibility must be one of private, unlisted or public"
+	}
+
+	for i, entry := range doc.Entries {
+		if entry.Title == "" {
+			errs[fmt.Sprintf("/entries/%d/title", i)] = "title is required"
+		}
+
+		if !validPriority(entry.Priority) {
+			errs[fmt.Sprintf("/entries/%d/priority", i)] = "priority must be between 0 and 3"
+		}
+	}
+
+	return errs
+}
+
+// HandlePatchListById applies a JSON Merge Patch (RFC 7396) or JSON Patch
+// (RFC 6902) document to a list, chosen by the request Content-Type.
+func (h *ListHandler) HandlePatchListById(w http.ResponseWriter, r *http.Request) {
+	listID, role, ok := h.access.readListRole(w, r)
+	if !ok {
+		return
+	}
+
+	if !store.RoleAllows(role, store.RoleEditor) {
+		h.access.forbidden(w)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != jsonpatch.MergePatchType && mediaType != jsonpatch.JSONPatchType) {
+		utils.WriteJSON(w, http.StatusUnsupportedMediaType, utils.Envelope{
+			"error": fmt.Sprintf("Content-Type must be %s or %s", jsonpatch.MergePatchType, jsonpatch.JSONPatchType),
+		})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readingPatchBody", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	existingList, err := h.listStore.GetListByID(r.Context(), listID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListById", err, "failed to fetch list")
+		return
+	}
+
+	if existingList == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
+		return
+	}
+
+	if !h.checkIfMatch(w, r, existingList) {
+		return
+	}
+
+	doc, err := jsonpatch.ToDocument(listPatchDocument{
+		Title:       existingList.Title,
+		Description: existingList.Description,
+		Visibility:  existingList.Visibility,
+		Entries:     existingList.Entries,
+	})
+	if err != nil {
+		utils.WriteServerError(w, r, "encodingPatchDocument", err, "internal server error")
+		return
+	}
+
+	if mediaType == jsonpatch.MergePatchType {
+		var patch map[string]interface{}
+		err = json.Unmarshal(body, &patch)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "a merge patch must be a JSON object"})
+			return
+		}
+
+		errs := map[string]string{}
+		for key := range patch {
+			pathErr := checkPatchPath("/" + key)
+			if pathErr != nil {
+				errs["/"+key] = pathErr.Error()
+			}
+		}
+
+		if len(errs) > 0 {
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid patch", "fields": errs})
+			return
+		}
+
+		doc = jsonpatch.MergePatch(doc, patch)
+	} else {
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+
+		opErrs := patch.Validate()
+		for i, op := range patch {
+			paths := []string{op.Path}
+			if op.Op == "move" || op.Op == "copy" {
+				paths = append(paths, op.From)
+			}
+
+			for _, path := range paths {
+				pathErr := checkPatchPath(path)
+				if pathErr != nil {
+					opErrs = append(opErrs, &jsonpatch.OperationError{Index: i, Op: op.Op, Path: path, Err: pathErr.Error()})
+				}
+			}
+		}
+
+		if len(opErrs) > 0 {
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid patch", "operations": opErrs})
 			return
 		}
 
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		doc, err = patch.Apply(doc)
+		if err != nil {
+			var opErr *jsonpatch.OperationError
+			if errors.As(err, &opErr) {
+				utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid patch", "operations": []*jsonpatch.OperationError{opErr}})
+				return
+			}
+
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": err.Error()})
+			return
+		}
+	}
+
+	var patched listPatchDocument
+	err = jsonpatch.FromDocument(doc, &patched)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "patched list is invalid: " + err.Error()})
 		return
 	}
 
-	if listOwner != currentUser.ID {
-		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to delete this list"})
+	errs := validatePatchedList(&patched)
+	if len(errs) > 0 {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid patch", "fields": errs})
 		return
 	}
 
-	err = h.listStore.DeleteList(listID)
-	if err == sql.ErrNoRows {
-		h.logger.Printf("ERROR: deletingList: %v", err)
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list does not exist"})
+	if patched.Visibility != existingList.Visibility && !store.RoleAllows(role, store.RoleOwner) {
+		h.access.forbidden(w)
+		return
+	}
+
+	for i := range patched.Entries {
+		patched.Entries[i].OrderIndex = i
+	}
+
+	existingList.Title = patched.Title
+	existingList.Description = patched.Description
+	existingList.Visibility = patched.Visibility
+	existingList.Entries = patched.Entries
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.listStore.UpdateList(r.Context(), existingList, currentUser.ID)
+	if errors.Is(err, store.ErrEditConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": err.Error()})
 		return
 	}
 
 	if err != nil {
-		h.logger.Printf("ERROR: deletingList: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to delete list"})
+		utils.WriteServerError(w, r, "updatingList", err, "failed to update list")
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"list": "deleted successfully"})
+	w.Header().Set("ETag", utils.ETag(existingList.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": existingList})
 }
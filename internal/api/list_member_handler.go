@@ -0,0 +1,210 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+type ListMemberHandler struct {
+	listStore store.ListStore
+	userStore store.UserStore
+	access    listAccess
+}
+
+func NewListMemberHandler(listStore store.ListStore, userStore store.UserStore) *ListMemberHandler {
+	return &ListMemberHandler{
+		listStore: listStore,
+		userStore: userStore,
+		access:    listAccess{listStore: listStore},
+	}
+}
+
+type addListMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type updateListMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// readMember looks up the user named in the route. It writes the error
+// response itself and returns nil when the request should not continue.
+func (h *ListMemberHandler) readMember(w http.ResponseWriter, r *http.Request) *store.User {
+	user, err := h.userStore.GetUserByUsername(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		utils.WriteServerError(w, r, "getUserByUsername", err, "internal server error")
+		return nil
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return nil
+	}
+
+	return user
+}
+
+func (h *ListMemberHandler) HandleGetListMembers(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := h.listStore.GetListMembers(r.Context(), listID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListMembers", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"members": members})
+}
+
+func (h *ListMemberHandler) HandleAddListMember(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req addListMemberRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingAddListMember", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Username == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "username is required"})
+		return
+	}
+
+	if !store.ValidRole(req.Role) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "role must be one of viewer, editor or owner"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		utils.WriteServerError(w, r, "getUserByUsername", err, "internal server error")
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	err = h.listStore.AddListMember(r.Context(), listID, user.ID, req.Role)
+	if errors.Is(err, store.ErrAlreadyMember) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "addListMember", err, "failed to add member")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"member": store.ListMember{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     req.Role,
+	}})
+}
+
+func (h *ListMemberHandler) HandleUpdateListMember(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req updateListMemberRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingUpdateListMember", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if !store.ValidRole(req.Role) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "role must be one of viewer, editor or owner"})
+		return
+	}
+
+	user := h.readMember(w, r)
+	if user == nil {
+		return
+	}
+
+	err = h.listStore.UpdateListMemberRole(r.Context(), listID, user.ID, req.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user is not a member of this list"})
+		return
+	}
+
+	if errors.Is(err, store.ErrLastOwner) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "updateListMemberRole", err, "failed to update member")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"member": store.ListMember{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     req.Role,
+	}})
+}
+
+// HandleRemoveListMember lets owners remove anyone and lets any member remove
+// themselves from a list.
+func (h *ListMemberHandler) HandleRemoveListMember(w http.ResponseWriter, r *http.Request) {
+	listID, role, ok := h.access.readListRole(w, r)
+	if !ok {
+		return
+	}
+
+	// Permission is checked before the username is looked up, so callers
+	// cannot use the response to find out which usernames exist.
+	currentUser := middleware.GetUser(r)
+	leaving := chi.URLParam(r, "username") == currentUser.Username && store.RoleAllows(role, store.RoleViewer)
+	if !leaving && !store.RoleAllows(role, store.RoleOwner) {
+		h.access.forbidden(w)
+		return
+	}
+
+	user := h.readMember(w, r)
+	if user == nil {
+		return
+	}
+
+	err := h.listStore.RemoveListMember(r.Context(), listID, user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user is not a member of this list"})
+		return
+	}
+
+	if errors.Is(err, store.ErrLastOwner) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "removeListMember", err, "failed to remove member")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"member": "removed successfully"})
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+type ListRevisionHandler struct {
+	listStore store.ListStore
+	access    listAccess
+}
+
+func NewListRevisionHandler(listStore store.ListStore) *ListRevisionHandler {
+	return &ListRevisionHandler{
+		listStore: listStore,
+		access:    listAccess{listStore: listStore},
+	}
+}
+
+// readRevision loads the revision named in the route. It writes the error
+// response itself and returns nil when the request should not continue.
+func (h *ListRevisionHandler) readRevision(w http.ResponseWriter, r *http.Request, listID int64, param string) *store.ListRevision {
+	number, err := strconv.Atoi(chi.URLParam(r, param))
+	if err != nil || number < 1 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid revision"})
+		return nil
+	}
+
+	return h.loadRevision(w, r, listID, number)
+}
+
+func (h *ListRevisionHandler) loadRevision(w http.ResponseWriter, r *http.Request, listID int64, number int) *store.ListRevision {
+	revision, err := h.listStore.GetListRevision(r.Context(), listID, number)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListRevision", err, "internal server error")
+		return nil
+	}
+
+	if revision == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+		return nil
+	}
+
+	return revision
+}
+
+func (h *ListRevisionHandler) HandleGetListRevisions(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleViewer)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.listStore.GetListRevisions(r.Context(), listID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListRevisions", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revisions": revisions})
+}
+
+func (h *ListRevisionHandler) HandleGetListRevision(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleViewer)
+	if !ok {
+		return
+	}
+
+	revision := h.readRevision(w, r, listID, "rev")
+	if revision == nil {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revision": revision})
+}
+
+// HandleDiffListRevisions compares a revision with the one given in the
+// "against" query parameter, or with the revision before it by default.
+func (h *ListRevisionHandler) HandleDiffListRevisions(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleViewer)
+	if !ok {
+		return
+	}
+
+	to := h.readRevision(w, r, listID, "rev")
+	if to == nil {
+		return
+	}
+
+	against := to.Revision - 1
+	if param := r.URL.Query().Get("against"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid against revision"})
+			return
+		}
+		against = n
+	}
+
+	from := &store.ListRevision{}
+	if against > 0 {
+		from = h.loadRevision(w, r, listID, against)
+		if from == nil {
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"diff": store.DiffRevisions(from, to)})
+}
+
+// HandleRestoreListRevision makes a past revision the current state of the
+// list. The restore is itself recorded as a new revision.
+func (h *ListRevisionHandler) HandleRestoreListRevision(w http.ResponseWriter, r *http.Request) {
+	listID, ok := h.access.authorize(w, r, store.RoleEditor)
+	if !ok {
+		return
+	}
+
+	revision := h.readRevision(w, r, listID, "rev")
+	if revision == nil {
+		return
+	}
+
+	list, err := h.listStore.GetListByID(r.Context(), listID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getListByID", err, "internal server error")
+		return
+	}
+
+	if list == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
+		return
+	}
+
+	list.Title = revision.Title
+	list.Description = revision.Description
+	list.Entries = revision.Entries
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.listStore.UpdateList(r.Context(), list, currentUser.ID)
+	if errors.Is(err, store.ErrEditConflict) {
+		utils.WriteJSON(w, http.StatusPreconditionFailed, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "updatingList", err, "failed to restore revision")
+		return
+	}
+
+	w.Header().Set("ETag", utils.ETag(list.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"list": list})
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+// UsernameLoginKey and IPLoginKey name the counters failed logins are
+// tracked under.
+func UsernameLoginKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+func IPLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginGuard counts failed password and code checks per username and per
+// client IP, and locks each out according to UsernamePolicy and IPPolicy
+// respectively. Every handler that checks a password goes through it, so a
+// stolen session cannot be used to guess the password without limit either.
+type loginGuard struct {
+	loginAttemptStore store.LoginAttemptStore
+	UsernamePolicy    store.LoginPolicy
+	IPPolicy          store.LoginPolicy
+}
+
+func newLoginGuard(loginAttemptStore store.LoginAttemptStore) loginGuard {
+	return loginGuard{
+		loginAttemptStore: loginAttemptStore,
+		UsernamePolicy: store.LoginPolicy{
+			FreeAttempts: 5,
+			BaseLockout:  30 * time.Second,
+			MaxLockout:   time.Hour,
+			ResetAfter:   24 * time.Hour,
+		},
+		IPPolicy: store.LoginPolicy{
+			FreeAttempts: 20,
+			BaseLockout:  30 * time.Second,
+			MaxLockout:   time.Hour,
+			ResetAfter:   24 * time.Hour,
+		},
+	}
+}
+
+// checkLockout writes a 429 response and returns false if the username or
+// the client's IP is locked out.
+func (g *loginGuard) checkLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	lockedUntil, err := g.loginAttemptStore.GetLockedUntil(r.Context(), []string{UsernameLoginKey(username), IPLoginKey(utils.ClientIP(r))})
+	if err != nil {
+		utils.WriteServerError(w, r, "getLockedUntil", err, "internal server error")
+		return false
+	}
+
+	if lockedUntil != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(*lockedUntil).Seconds()))))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many failed login attempts, try again later"})
+		return false
+	}
+
+	return true
+}
+
+// recordFailure counts a failed check against the username and the client's
+// IP.
+func (g *loginGuard) recordFailure(r *http.Request, username string) {
+	ip := utils.ClientIP(r)
+
+	logger := logging.FromContext(r.Context())
+
+	for key, policy := range map[string]store.LoginPolicy{UsernameLoginKey(username): g.UsernamePolicy, IPLoginKey(ip): g.IPPolicy} {
+		lockedUntil, err := g.loginAttemptStore.RecordFailure(r.Context(), key, policy)
+		if err != nil {
+			logger.Error("recording failed login failed", "op", "recordFailure", "error", err)
+			continue
+		}
+
+		if lockedUntil != nil {
+			logger.Warn("login locked out", "key", key, "locked_until", *lockedUntil)
+		}
+	}
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// client's IP and responds with 401.
+func (g *loginGuard) recordLoginFailure(w http.ResponseWriter, r *http.Request, username, message string) {
+	g.recordFailure(r, username)
+
+	utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": message})
+}
+
+// resetLoginFailures forgets the failed logins of username after a successful
+// login. Failures from the client's IP are kept, so one valid account cannot
+// be used to keep guessing the passwords of others.
+func (g *loginGuard) resetLoginFailures(ctx context.Context, username string) {
+	err := g.loginAttemptStore.ResetAttempts(ctx, UsernameLoginKey(username))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logging.FromContext(ctx).Error("resetting failed logins failed", "op", "resetAttempts", "error", err)
+	}
+}
+
+// confirmPassword checks plaintext against the password of a signed in user,
+// who is locked out like a login after too many wrong passwords. It writes the
+// error response itself and returns false when the request should not
+// continue.
+func (g *loginGuard) confirmPassword(w http.ResponseWriter, r *http.Request, userStore store.UserStore, user *store.User, plaintext string) bool {
+	if !g.checkLockout(w, r, user.Username) {
+		return false
+	}
+
+	matches, err := userStore.PasswordMatches(user, plaintext)
+	if err != nil {
+		utils.WriteServerError(w, r, "passwordMatches", err, "internal server error")
+		return false
+	}
+
+	if !matches {
+		g.recordFailure(r, user.Username)
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "password is incorrect"})
+		return false
+	}
+
+	g.resetLoginFailures(r.Context(), user.Username)
+	return true
+}
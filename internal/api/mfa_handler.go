@@ -0,0 +1,157 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/tokens"
+	"github.com/mikemcavoydev/list-api/internal/totp"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+const recoveryCodeCount = 10
+
+// MFAHandler lets users enroll in, and turn off, TOTP two-factor
+// authentication. Issuer is the name authenticator apps show for the account.
+type MFAHandler struct {
+	loginGuard
+	userStore store.UserStore
+	Issuer    string
+}
+
+func NewMFAHandler(userStore store.UserStore, loginAttemptStore store.LoginAttemptStore) *MFAHandler {
+	return &MFAHandler{
+		loginGuard: newLoginGuard(loginAttemptStore),
+		userStore:  userStore,
+		Issuer:     "List API",
+	}
+}
+
+type confirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type disableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// HandleEnrollTOTP starts enrollment by generating a new secret. It is only
+// used for logins once confirmed with HandleConfirmTOTP.
+func (h *MFAHandler) HandleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		utils.WriteServerError(w, r, "generateSecret", err, "internal server error")
+		return
+	}
+
+	err = h.userStore.StartTOTPEnrollment(r.Context(), currentUser.ID, secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "startTOTPEnrollment", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"totp": utils.Envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(h.Issuer, currentUser.Username, secret),
+	}})
+}
+
+// HandleConfirmTOTP enables two-factor authentication once the user proves
+// their authenticator works, and returns their recovery codes. The codes are
+// only stored hashed, so this is the only time they are shown.
+func (h *MFAHandler) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req confirmTOTPRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingConfirmTOTP", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	settings, err := h.userStore.GetTOTP(r.Context(), currentUser.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getTOTP", err, "internal server error")
+		return
+	}
+
+	if settings.Enabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if settings.Secret == nil {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "start enrollment before confirming it"})
+		return
+	}
+
+	step, ok := totp.Validate(*settings.Secret, req.Code, time.Now())
+	if !ok {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid code"})
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = tokens.GenerateRecoveryCode()
+		if err != nil {
+			utils.WriteServerError(w, r, "generateRecoveryCode", err, "internal server error")
+			return
+		}
+		hashes[i] = tokens.Hash(codes[i])
+	}
+
+	err = h.userStore.EnableTOTP(r.Context(), currentUser.ID, step, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "enableTOTP", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"recovery_codes": codes})
+}
+
+// HandleDisableTOTP turns two-factor authentication off after the user
+// confirms their password.
+func (h *MFAHandler) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req disableTOTPRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingDisableTOTP", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if !h.confirmPassword(w, r, h.userStore, currentUser, req.Password) {
+		return
+	}
+
+	err = h.userStore.DisableTOTP(r.Context(), currentUser.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "disableTOTP", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"totp": "disabled successfully"})
+}
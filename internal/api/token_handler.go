@@ -1,27 +1,75 @@
 package api
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/mikemcavoydev/list-api/internal/jwt"
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/mailer"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
 	"github.com/mikemcavoydev/list-api/internal/store"
 	"github.com/mikemcavoydev/list-api/internal/tokens"
+	"github.com/mikemcavoydev/list-api/internal/totp"
 	"github.com/mikemcavoydev/list-api/internal/utils"
 )
 
+// TokenHandler issues short-lived access tokens together with refresh tokens
+// that can be exchanged for a new pair until they expire.
+//
+// Failed logins are counted per username and per client IP, and each is
+// locked out according to UsernamePolicy and IPPolicy respectively.
+//
+// When JWTKeys is set, access tokens are JWTs signed with it instead of
+// opaque tokens. Each still has a stored session behind it, so refreshing and
+// listing sessions work as before. Signing a session out records its JWT as
+// revoked; logging out with the JWT itself rejects it at once, any other
+// revocation once the denylist is next synced.
 type TokenHandler struct {
-	tokenStore store.TokenStore
-	userStore  store.UserStore
-	logger     *log.Logger
+	loginGuard
+	tokenStore        store.TokenStore
+	userStore         store.UserStore
+	revokedTokenStore store.RevokedTokenStore
+	denylist          *jwt.Denylist
+	mailer            mailer.Mailer
+	AccessTokenTTL    time.Duration
+	RefreshTokenTTL   time.Duration
+	PasswordResetTTL  time.Duration
+	MFAPendingTTL     time.Duration
+	JWTKeys           *jwt.KeySet
+
+	// PasswordResetInterval is how long a user has to wait between password
+	// reset emails.
+	PasswordResetInterval time.Duration
+
+	// Background runs work that outlives the request, such as sending
+	// email. It starts a goroutine unless NewApplication tracks the work so
+	// shutdown can wait for it.
+	Background func(task func())
 }
 
-func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
+func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, loginAttemptStore store.LoginAttemptStore, revokedTokenStore store.RevokedTokenStore, denylist *jwt.Denylist, mailer mailer.Mailer) *TokenHandler {
 	return &TokenHandler{
-		tokenStore: tokenStore,
-		userStore:  userStore,
-		logger:     logger,
+		loginGuard:        newLoginGuard(loginAttemptStore),
+		tokenStore:        tokenStore,
+		userStore:         userStore,
+		revokedTokenStore: revokedTokenStore,
+		denylist:          denylist,
+		mailer:            mailer,
+		Background:        runInBackground,
+		AccessTokenTTL:    15 * time.Minute,
+		RefreshTokenTTL:   30 * 24 * time.Hour,
+		PasswordResetTTL:  45 * time.Minute,
+		MFAPendingTTL:     5 * time.Minute,
+
+		PasswordResetInterval: time.Minute,
 	}
 }
 
@@ -30,40 +78,556 @@ type createTokenRequest struct {
 	Password string `json:"password"`
 }
 
+type createPersonalTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type verifyMFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 	var req createTokenRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERROR: createTokenRequest: %v", err)
+		logging.FromContext(r.Context()).Info("invalid request", "op", "createTokenRequest", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid payload request"})
 		return
 	}
 
-	user, err := h.userStore.GetUserByUsername(req.Username)
-	if err != nil || user == nil {
-		h.logger.Printf("ERROR: getUserByUsername: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+	if !h.checkLockout(w, r, req.Username) {
+		return
+	}
+
+	user, err := h.userStore.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		utils.WriteServerError(w, r, "getUserByUsername", err, "internal server error")
+		return
+	}
+
+	// Unknown users get the same response, in the same time, as a wrong
+	// password, so logins cannot be used to find out which usernames exist.
+	if user == nil {
+		h.userStore.DummyPasswordCheck(req.Password)
+		h.recordLoginFailure(w, r, req.Username, "invalid credentials")
 		return
 	}
 
-	passwordsDoMatch, err := user.PasswordHash.Matches(req.Password)
+	passwordsDoMatch, err := h.userStore.PasswordMatches(user, req.Password)
 	if err != nil {
-		h.logger.Printf("ERROR: passwordHash.Matches: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		utils.WriteServerError(w, r, "passwordMatches", err, "internal server error")
 		return
 	}
 
 	if !passwordsDoMatch {
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
+		h.recordLoginFailure(w, r, req.Username, "invalid credentials")
+		return
+	}
+
+	if h.userStore.PasswordNeedsRehash(user) {
+		h.rehashPassword(r.Context(), user, req.Password)
+	}
+
+	settings, err := h.userStore.GetTOTP(r.Context(), user.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getTOTP", err, "internal server error")
+		return
+	}
+
+	if settings.Enabled {
+		mfaToken, err := h.tokenStore.CreateNewToken(r.Context(), user.ID, h.MFAPendingTTL, tokens.ScopeMFAPending)
+		if err != nil {
+			utils.WriteServerError(w, r, "createNewToken", err, "internal server error")
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"mfa_required": true, "mfa_token": mfaToken})
+		return
+	}
+
+	h.resetLoginFailures(r.Context(), user.Username)
+	h.issueSession(w, r, user)
+}
+
+// rehashPassword upgrades a password hash made with outdated settings while
+// the plaintext is at hand. Failing to do so does not fail the login.
+func (h *TokenHandler) rehashPassword(ctx context.Context, user *store.User, plaintext string) {
+	err := h.userStore.SetPassword(user, plaintext)
+	if err != nil {
+		logging.FromContext(ctx).Error("rehashing password failed", "op", "setPassword", "error", err)
+		return
+	}
+
+	err = h.userStore.RehashPassword(ctx, user)
+	if err != nil {
+		logging.FromContext(ctx).Error("rehashing password failed", "op", "rehashPassword", "error", err)
+	}
+}
+
+// issueSession creates a new token family for user and responds with its
+// access and refresh token.
+func (h *TokenHandler) issueSession(w http.ResponseWriter, r *http.Request, user *store.User) {
+	family, err := tokens.NewFamily()
+	if err != nil {
+		utils.WriteServerError(w, r, "newFamily", err, "internal server error")
+		return
+	}
+
+	access, refresh, err := tokens.GeneratePair(user.ID, family, h.AccessTokenTTL, h.RefreshTokenTTL)
+	if err != nil {
+		utils.WriteServerError(w, r, "generatePair", err, "internal server error")
+		return
+	}
+
+	for _, token := range []*tokens.Token{access, refresh} {
+		token.UserAgent = r.UserAgent()
+		token.IP = utils.ClientIP(r)
+	}
+
+	err = h.tokenStore.InsertPair(r.Context(), access, refresh)
+	if err != nil {
+		utils.WriteServerError(w, r, "insertPair", err, "internal server error")
+		return
+	}
+
+	if h.JWTKeys != nil {
+		err = h.signAccessToken(access, user)
+		if err != nil {
+			utils.WriteServerError(w, r, "signAccessToken", err, "internal server error")
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": access, "refresh_token": refresh})
+}
+
+// signAccessToken replaces the plaintext of a stored access token with a JWT
+// for the same session. The JWT's ID is the stored token's hash.
+func (h *TokenHandler) signAccessToken(access *tokens.Token, user *store.User) error {
+	signed, err := h.JWTKeys.Sign(jwt.Claims{
+		Subject:   strconv.Itoa(user.ID),
+		Username:  user.Username,
+		Scope:     access.Scope,
+		Activated: user.Activated,
+		ID:        base64.RawURLEncoding.EncodeToString(access.Hash),
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: access.Expiry.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	access.Plaintext = signed
+	return nil
+}
+
+// HandleVerifyMFA completes a login for a user with two-factor
+// authentication, exchanging the MFA token from /tokens/authenticate and a
+// TOTP or recovery code for a session. MFA tokens can only be used once, so a
+// wrong code means logging in with the password again.
+func (h *TokenHandler) HandleVerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req verifyMFARequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "verifyMFARequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid payload request"})
+		return
+	}
+
+	if req.MFAToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "mfa_token is required"})
+		return
+	}
+
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "provide either code or recovery_code"})
+		return
+	}
+
+	// The token is consumed before the code is checked, so it allows a
+	// single attempt even when requests using it arrive concurrently.
+	user, err := h.userStore.ConsumeUserToken(r.Context(), tokens.ScopeMFAPending, req.MFAToken)
+	if err != nil {
+		utils.WriteServerError(w, r, "consumeUserToken", err, "internal server error")
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	if !h.checkLockout(w, r, user.Username) {
+		return
+	}
+
+	settings, err := h.userStore.GetTOTP(r.Context(), user.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getTOTP", err, "internal server error")
+		return
+	}
+
+	verified := false
+	if settings.Enabled && settings.Secret != nil {
+		if req.Code != "" {
+			step, ok := totp.Validate(*settings.Secret, req.Code, time.Now())
+			if ok {
+				verified, err = h.userStore.RecordTOTPStep(r.Context(), user.ID, step)
+			}
+		} else {
+			verified, err = h.userStore.UseRecoveryCode(r.Context(), user.ID, tokens.Hash(tokens.NormaliseRecoveryCode(req.RecoveryCode)))
+		}
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "verifyMFA", err, "internal server error")
+		return
+	}
+
+	if !verified {
+		h.recordLoginFailure(w, r, user.Username, "invalid code")
+		return
+	}
+
+	h.resetLoginFailures(r.Context(), user.Username)
+	h.issueSession(w, r, user)
+}
+
+// HandleRefreshToken exchanges a refresh token for a new access and refresh
+// token. The presented refresh token cannot be used again.
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "refreshTokenRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid payload request"})
+		return
+	}
+
+	if req.RefreshToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "refresh_token is required"})
+		return
+	}
+
+	access, refresh, err := h.tokenStore.RotateRefreshToken(r.Context(),
+		req.RefreshToken, h.AccessTokenTTL, h.RefreshTokenTTL, r.UserAgent(), utils.ClientIP(r))
+	if errors.Is(err, store.ErrRefreshTokenReused) {
+		logging.FromContext(r.Context()).Warn("refresh token reused, revoked its token family")
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid refresh token"})
+		return
+	}
+
+	if errors.Is(err, store.ErrInvalidRefreshToken) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid refresh token"})
 		return
 	}
 
-	token, err := h.tokenStore.CreateNewToken(user.ID, 24*time.Hour, tokens.ScopeAuth)
 	if err != nil {
-		h.logger.Printf("ERROR: createNewToken: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		utils.WriteServerError(w, r, "rotateRefreshToken", err, "internal server error")
+		return
+	}
+
+	if h.JWTKeys != nil {
+		user, err := h.userStore.GetUserByID(r.Context(), access.UserID)
+		if err != nil {
+			utils.WriteServerError(w, r, "getUserByID", err, "internal server error")
+			return
+		}
+
+		if user == nil {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid refresh token"})
+			return
+		}
+
+		err = h.signAccessToken(access, user)
+		if err != nil {
+			utils.WriteServerError(w, r, "signAccessToken", err, "internal server error")
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"auth_token": access, "refresh_token": refresh})
+}
+
+func (h *TokenHandler) HandleGetTokens(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	sessions, err := h.tokenStore.GetSessionsForUser(r.Context(), currentUser.ID, tokens.ScopeAuth, middleware.GetTokenHash(r))
+	if err != nil {
+		utils.WriteServerError(w, r, "getSessionsForUser", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+// HandleDeleteCurrentToken revokes the token the request was authenticated
+// with and the refresh token issued alongside it. An access JWT is added to
+// the denylist until it expires.
+func (h *TokenHandler) HandleDeleteCurrentToken(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r)
+	if claims != nil {
+		err := h.revokedTokenStore.Revoke(r.Context(), claims.ID, claims.Expiry())
+		if err != nil {
+			utils.WriteServerError(w, r, "revoke", err, "failed to revoke token")
+			return
+		}
+
+		h.denylist.Add(claims.ID, claims.Expiry())
+	}
+
+	err := h.tokenStore.DeleteToken(r.Context(), middleware.GetTokenHash(r))
+	// The session behind a JWT may be gone already while the JWT itself was
+	// valid until now.
+	if errors.Is(err, sql.ErrNoRows) && claims != nil {
+		err = nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "token not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "deleteToken", err, "failed to revoke token")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"token": "revoked successfully"})
+}
+
+// HandleDeleteAllTokens logs the current user out of every session.
+func (h *TokenHandler) HandleDeleteAllTokens(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh} {
+		err := h.tokenStore.DeleteAllTokensForUser(r.Context(), currentUser.ID, scope)
+		if err != nil {
+			utils.WriteServerError(w, r, "deleteAllTokensForUser", err, "failed to revoke tokens")
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"tokens": "revoked successfully"})
+}
+
+func (h *TokenHandler) HandleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := utils.ReadIDParam(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid token id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.tokenStore.DeleteTokenForUser(r.Context(), tokenID, currentUser.ID, tokens.ScopeAuth)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "token not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "deleteTokenForUser", err, "failed to revoke token")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"token": "revoked successfully"})
+}
+
+func (h *TokenHandler) HandleCreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	var req createPersonalTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "createPersonalTokenRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid payload request"})
+		return
+	}
+
+	if req.Name == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name is required"})
+		return
+	}
+
+	if len(req.Name) > 100 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name cannot be greater than 100 characters"})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "at least one scope is required"})
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !tokens.ValidPermission(scope) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "scopes must be lists:read, lists:write or account:manage"})
+			return
+		}
+	}
+
+	// A personal access token can only create tokens limited to its own
+	// permissions, so a leaked token cannot be used to widen its access.
+	granted := middleware.GetPermissions(r)
+	for _, scope := range req.Scopes {
+		if !tokens.HasPermission(granted, scope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "a token cannot grant scopes it does not have"})
+			return
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "expires_at must be in the future"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	token := &store.PersonalToken{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	err = h.tokenStore.CreatePersonalToken(r.Context(), currentUser.ID, token)
+	if err != nil {
+		utils.WriteServerError(w, r, "createPersonalToken", err, "failed to create token")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"token": token})
+}
+
+func (h *TokenHandler) HandleGetPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	personalTokens, err := h.tokenStore.GetPersonalTokensForUser(r.Context(), currentUser.ID)
+	if err != nil {
+		utils.WriteServerError(w, r, "getPersonalTokensForUser", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tokens": personalTokens})
+}
+
+func (h *TokenHandler) HandleDeletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := utils.ReadIDParam(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid token id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.tokenStore.DeleteTokenForUser(r.Context(), tokenID, currentUser.ID, tokens.ScopePersonal)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "token not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "deleteTokenForUser", err, "failed to revoke token")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"token": "revoked successfully"})
+}
+
+// HandleCreatePasswordResetToken emails a password reset token to the user
+// with the given address. It responds the same way whether or not such a user
+// exists, so it cannot be used to find out which addresses are registered.
+// A user gets at most one email per PasswordResetInterval.
+func (h *TokenHandler) HandleCreatePasswordResetToken(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "passwordResetRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid payload request"})
+		return
+	}
+
+	if req.Email == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByEmail(r.Context(), req.Email)
+	if err != nil {
+		utils.WriteServerError(w, r, "getUserByEmail", err, "internal server error")
+		return
+	}
+
+	accepted := utils.Envelope{"message": "if an account with that email exists, a password reset token has been sent to it"}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+
+	// Creating and sending the token happen in the background so the response
+	// time does not reveal whether the address belongs to a user.
+	ctx := context.WithoutCancel(r.Context())
+	h.Background(func() {
+		// Requests within PasswordResetInterval of the last email get the same
+		// response but send nothing, so the endpoint cannot be used to flood
+		// someone's inbox.
+		lastSent, err := h.tokenStore.GetLatestTokenCreatedAt(ctx, user.ID, tokens.ScopePasswordReset)
+		if err != nil {
+			logging.FromContext(ctx).Error("creating password reset token failed", "op", "getLatestTokenCreatedAt", "error", err)
+			return
+		}
+
+		if lastSent != nil && time.Since(*lastSent) < h.PasswordResetInterval {
+			logging.FromContext(ctx).Info("password reset email throttled", "user_id", user.ID)
+			return
+		}
+
+		err = h.tokenStore.DeleteAllTokensForUser(ctx, user.ID, tokens.ScopePasswordReset)
+		if err != nil {
+			logging.FromContext(ctx).Error("creating password reset token failed", "op", "deleteAllTokensForUser", "error", err)
+			return
+		}
+
+		token, err := h.tokenStore.CreateNewToken(ctx, user.ID, h.PasswordResetTTL, tokens.ScopePasswordReset)
+		if err != nil {
+			logging.FromContext(ctx).Error("creating password reset token failed", "op", "createNewToken", "error", err)
+			return
+		}
+
+		body := fmt.Sprintf(
+			"Hi %s,\n\nUse this token to reset your password:\n\n%s\n\nSend it with your new password to PUT /users/password. It expires at %s.\n",
+			user.Username, token.Plaintext, token.Expiry.UTC().Format(time.RFC1123),
+		)
+
+		err = h.mailer.Send(user.Email, "Reset your password", body)
+		if err != nil {
+			logging.FromContext(ctx).Error("sending email failed", "op", "sendPasswordResetEmail", "error", err)
+		}
+	})
+
+	utils.WriteJSON(w, http.StatusAccepted, accepted)
+}
+
+// HandleGetJWKS publishes the public keys access JWTs are signed with, so
+// other services can verify them.
+func (h *TokenHandler) HandleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	if h.JWTKeys == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "access tokens are not JWTs"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"keys": h.JWTKeys.JWKS()})
 }
@@ -1,13 +1,23 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/mailer"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/passwords"
 	"github.com/mikemcavoydev/list-api/internal/store"
+	"github.com/mikemcavoydev/list-api/internal/tokens"
 	"github.com/mikemcavoydev/list-api/internal/utils"
 )
 
@@ -17,41 +27,97 @@ type registerUserRequest struct {
 	Password string `json:"password"`
 }
 
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type activateUserRequest struct {
+	Token string `json:"token"`
+}
+
+type updateUserRequest struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type deleteUserRequest struct {
+	Password string `json:"password"`
+}
+
 type UserHandler struct {
-	userStore store.UserStore
-	logger    *log.Logger
+	loginGuard
+	userStore                store.UserStore
+	tokenStore               store.TokenStore
+	mailer                   mailer.Mailer
+	ActivationTTL            time.Duration
+	ActivationResendInterval time.Duration
+	PasswordPolicy           passwords.Policy
+
+	// Background runs work that outlives the request, as on TokenHandler.
+	Background func(task func())
 }
 
-func NewUserHandler(userStore store.UserStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, loginAttemptStore store.LoginAttemptStore, mailer mailer.Mailer) *UserHandler {
 	return &UserHandler{
-		userStore: userStore,
-		logger:    logger,
+		loginGuard:               newLoginGuard(loginAttemptStore),
+		userStore:                userStore,
+		tokenStore:               tokenStore,
+		mailer:                   mailer,
+		Background:               runInBackground,
+		ActivationTTL:            3 * 24 * time.Hour,
+		ActivationResendInterval: time.Minute,
+		PasswordPolicy:           passwords.DefaultPolicy,
 	}
 }
 
-func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
-	if req.Username == "" {
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+func validateUsername(username string) error {
+	if username == "" {
 		return errors.New("username is required")
 	}
 
-	if req.Email == "" {
-		return errors.New("email is required")
+	if len(username) > 50 {
+		return errors.New("username cannot be greater than 50 characters")
 	}
 
-	if len(req.Username) > 50 {
-		return errors.New("username cannot be greater than 50 characters")
+	return nil
+}
+
+func validateEmail(email string) error {
+	if email == "" {
+		return errors.New("email is required")
 	}
 
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	if !emailRegex.MatchString(req.Email) {
+	if !emailRegex.MatchString(email) {
 		return errors.New("invalid email format")
 	}
 
+	return nil
+}
+
+func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
+	err := validateUsername(req.Username)
+	if err != nil {
+		return err
+	}
+
+	err = validateEmail(req.Email)
+	if err != nil {
+		return err
+	}
+
 	if req.Password == "" {
 		return errors.New("password is required")
 	}
 
-	return nil
+	return h.PasswordPolicy.Validate(req.Password)
 }
 
 func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -59,7 +125,7 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERRORL decoding register request: %v", err)
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingRegisterUser", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
@@ -75,19 +141,326 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 		Email:    req.Email,
 	}
 
-	err = user.PasswordHash.Set(req.Password)
+	err = h.userStore.SetPassword(user, req.Password)
 	if err != nil {
-		h.logger.Printf("ERROR: hashing password %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		utils.WriteServerError(w, r, "hashing password", err, "internal server error")
+		return
+	}
+
+	token, err := h.userStore.CreateUserWithActivationToken(r.Context(), user, h.ActivationTTL)
+	if errors.Is(err, store.ErrDuplicateUsername) || errors.Is(err, store.ErrDuplicateEmail) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
 		return
 	}
 
-	err = h.userStore.CreateUser(user)
 	if err != nil {
-		h.logger.Printf("ERROR: registering user %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		utils.WriteServerError(w, r, "registering user", err, "internal server error")
 		return
 	}
 
+	h.mailActivationToken(r.Context(), user, token)
+
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
 }
+
+// sendActivationToken replaces any activation token the user has with a new
+// one and emails it to them in the background.
+func (h *UserHandler) sendActivationToken(ctx context.Context, user *store.User) error {
+	err := h.tokenStore.DeleteAllTokensForUser(ctx, user.ID, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.tokenStore.CreateNewToken(ctx, user.ID, h.ActivationTTL, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	h.mailActivationToken(ctx, user, token)
+	return nil
+}
+
+// runInBackground is the default Background of the handlers.
+func runInBackground(task func()) {
+	go task()
+}
+
+// mailActivationToken emails the activation token to the user in the
+// background.
+func (h *UserHandler) mailActivationToken(ctx context.Context, user *store.User, token *tokens.Token) {
+	h.Background(func() {
+		body := fmt.Sprintf(
+			"Hi %s,\n\nUse this token to activate your account:\n\n%s\n\nSend it to PUT /users/activated. It expires at %s.\n",
+			user.Username, token.Plaintext, token.Expiry.UTC().Format(time.RFC1123),
+		)
+
+		err := h.mailer.Send(user.Email, "Activate your account", body)
+		if err != nil {
+			logging.FromContext(ctx).Error("sending email failed", "op", "sendActivationEmail", "error", err)
+		}
+	})
+}
+
+func (h *UserHandler) HandleActivateUser(w http.ResponseWriter, r *http.Request) {
+	var req activateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingActivateUser", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(r.Context(), tokens.ScopeActivation, req.Token)
+	if err != nil {
+		utils.WriteServerError(w, r, "getUserToken", err, "internal server error")
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid or expired activation token"})
+		return
+	}
+
+	err = h.userStore.ActivateUser(r.Context(), user)
+	if err != nil {
+		utils.WriteServerError(w, r, "activateUser", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleResendActivation sends the current user a new activation token. Users
+// have to wait ActivationResendInterval between requests.
+func (h *UserHandler) HandleResendActivation(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser.Activated {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "your account is already activated"})
+		return
+	}
+
+	lastSent, err := h.tokenStore.GetLatestTokenCreatedAt(r.Context(), currentUser.ID, tokens.ScopeActivation)
+	if err != nil {
+		utils.WriteServerError(w, r, "getLatestTokenCreatedAt", err, "internal server error")
+		return
+	}
+
+	if lastSent != nil {
+		wait := time.Until(lastSent.Add(h.ActivationResendInterval))
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "an activation email was sent recently, please wait before requesting another"})
+			return
+		}
+	}
+
+	err = h.sendActivationToken(r.Context(), currentUser)
+	if err != nil {
+		utils.WriteServerError(w, r, "sendActivationToken", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "an activation token has been sent to your email"})
+}
+
+// HandleResetPassword sets a new password using a password reset token and
+// signs the user out of every session.
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingResetPassword", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	if req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"})
+		return
+	}
+
+	err = h.PasswordPolicy.Validate(req.Password)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	// Consuming the token up front means concurrent requests with the same
+	// token cannot both set a password.
+	user, err := h.userStore.ConsumeUserToken(r.Context(), tokens.ScopePasswordReset, req.Token)
+	if err != nil {
+		utils.WriteServerError(w, r, "consumeUserToken", err, "internal server error")
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid or expired password reset token"})
+		return
+	}
+
+	err = h.userStore.SetPassword(user, req.Password)
+	if err != nil {
+		utils.WriteServerError(w, r, "hashing password", err, "internal server error")
+		return
+	}
+
+	err = h.userStore.UpdatePassword(r.Context(), user)
+	if err != nil {
+		utils.WriteServerError(w, r, "updatePassword", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "your password was reset successfully"})
+}
+
+func (h *UserHandler) HandleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": middleware.GetUser(r)})
+}
+
+// HandleUpdateCurrentUser changes the current user's username or email. A new
+// email address has to be verified again.
+func (h *UserHandler) HandleUpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var req updateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingUpdateUser", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	user := *middleware.GetUser(r)
+
+	if req.Username != nil {
+		err = validateUsername(*req.Username)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		user.Username = *req.Username
+	}
+
+	emailChanged := false
+	if req.Email != nil {
+		err = validateEmail(*req.Email)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+
+		emailChanged = *req.Email != user.Email
+		if emailChanged {
+			user.Email = *req.Email
+			user.Activated = false
+		}
+	}
+
+	err = h.userStore.UpdateUser(r.Context(), &user)
+	if errors.Is(err, store.ErrDuplicateUsername) || errors.Is(err, store.ErrDuplicateEmail) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "updateUser", err, "failed to update user")
+		return
+	}
+
+	if emailChanged {
+		err = h.sendActivationToken(r.Context(), &user)
+		if err != nil {
+			utils.WriteServerError(w, r, "sendActivationToken", err, "internal server error")
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleChangePassword sets a new password for the current user, who has to
+// confirm their current one. Every session is signed out afterwards.
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingChangePassword", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "current_password and new_password are required"})
+		return
+	}
+
+	err = h.PasswordPolicy.Validate(req.NewPassword)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	user := middleware.GetUser(r)
+	if !h.confirmPassword(w, r, h.userStore, user, req.CurrentPassword) {
+		return
+	}
+
+	err = h.userStore.SetPassword(user, req.NewPassword)
+	if err != nil {
+		utils.WriteServerError(w, r, "hashing password", err, "internal server error")
+		return
+	}
+
+	err = h.userStore.UpdatePassword(r.Context(), user)
+	if err != nil {
+		utils.WriteServerError(w, r, "updatePassword", err, "internal server error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "your password was changed, please log in again"})
+}
+
+// HandleDeleteCurrentUser deletes the current user after they confirm their
+// password. Their tokens and the lists only they own are deleted with them;
+// lists with other owners are kept.
+func (h *UserHandler) HandleDeleteCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var req deleteUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid request", "op", "decodingDeleteUser", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"})
+		return
+	}
+
+	user := middleware.GetUser(r)
+	if !h.confirmPassword(w, r, h.userStore, user, req.Password) {
+		return
+	}
+
+	err = h.userStore.DeleteUser(r.Context(), user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err != nil {
+		utils.WriteServerError(w, r, "deleteUser", err, "failed to delete user")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"user": "deleted successfully"})
+}
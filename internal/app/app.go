@@ -1,65 +1,277 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mikemcavoydev/list-api/internal/api"
+	"github.com/mikemcavoydev/list-api/internal/config"
+	"github.com/mikemcavoydev/list-api/internal/jwt"
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/mailer"
 	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/passwords"
 	"github.com/mikemcavoydev/list-api/internal/store"
 	"github.com/mikemcavoydev/list-api/migrations"
 )
 
 type Application struct {
-	Logger       *log.Logger
-	ListHandler  *api.ListHandler
-	UserHandler  *api.UserHandler
-	TokenHandler *api.TokenHandler
-	Middleware   middleware.UserMiddleware
-	DB           *sql.DB
+	Config              *config.Config
+	Logger              *slog.Logger
+	ListHandler         *api.ListHandler
+	ListEntryHandler    *api.ListEntryHandler
+	ListMemberHandler   *api.ListMemberHandler
+	ListRevisionHandler *api.ListRevisionHandler
+	UserHandler         *api.UserHandler
+	TokenHandler        *api.TokenHandler
+	MFAHandler          *api.MFAHandler
+	AdminHandler        *api.AdminHandler
+	Middleware          middleware.UserMiddleware
+	DB                  *sql.DB
+	listStore           store.ListStore
+	revokedTokenStore   store.RevokedTokenStore
+	denylist            *jwt.Denylist
+	draining            atomic.Bool
+	workersMu           sync.Mutex
+	workers             sync.WaitGroup
 }
 
-func NewApplication() (*Application, error) {
-	pgDB, err := store.Open()
+// NewApplication connects to the database, runs the migrations and sets up
+// the handlers as cfg describes.
+func NewApplication(cfg *config.Config, mail mailer.Mailer) (*Application, error) {
+	logger, err := logging.New(os.Stdout, cfg.LogFormat, cfg.LogLevel)
 	if err != nil {
 		return nil, err
 	}
 
-	err = store.MigrateFS(pgDB, migrations.FS, ".")
+	policy := passwords.DefaultPolicy
+	policy.MinLength = cfg.Passwords.MinLength
+	if cfg.Passwords.Hasher != "bcrypt" {
+		policy.MaxBytes = 0
+	}
+	if cfg.Passwords.BreachedFile != "" {
+		breached, err := passwords.LoadBreached(cfg.Passwords.BreachedFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading breached passwords: %w", err)
+		}
+		policy.Breached = breached
+	}
+
+	var jwtKeys *jwt.KeySet
+	if cfg.JWTKeyFile != "" {
+		jwtKeys, err = jwt.LoadKeySet(cfg.JWTKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading jwt keys: %w", err)
+		}
+	}
+
+	pgDB, err := store.Open(cfg.DB)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	logger.Info("connected to database")
 
-	listStore := store.NewPostgresListStore(pgDB)
-	listHandler := api.NewListHandler(listStore, logger)
+	err = store.MigrateFS(pgDB, migrations.FS, ".")
+	if err != nil {
+		pgDB.Close()
+		return nil, err
+	}
 
-	userStore := store.NewPostgresUserStore(pgDB)
-	userHandler := api.NewUserHandler(userStore, logger)
+	listStore := store.NewPostgresListStore(pgDB, cfg.DB.QueryTimeout)
+	listHandler := api.NewListHandler(listStore)
+	listHandler.RequireIfMatch = cfg.RequireIfMatch
+	listEntryHandler := api.NewListEntryHandler(listStore)
+	listRevisionHandler := api.NewListRevisionHandler(listStore)
 
-	tokenStore := store.NewPostgresTokenStore(pgDB)
-	tokenHandler := api.NewTokenHandler(tokenStore, userStore, logger)
+	userStore := store.NewPostgresUserStore(pgDB, newPasswordManager(cfg.Passwords), cfg.DB.QueryTimeout)
+	tokenStore := store.NewPostgresTokenStore(pgDB, cfg.DB.QueryTimeout)
+	loginAttemptStore := store.NewPostgresLoginAttemptStore(pgDB, cfg.DB.QueryTimeout)
+	userHandler := api.NewUserHandler(userStore, tokenStore, loginAttemptStore, mail)
+	userHandler.ActivationTTL = cfg.ActivationTTL
+	userHandler.PasswordPolicy = policy
+	listMemberHandler := api.NewListMemberHandler(listStore, userStore)
+	revokedTokenStore := store.NewPostgresRevokedTokenStore(pgDB, cfg.DB.QueryTimeout)
+	denylist := jwt.NewDenylist()
+	tokenHandler := api.NewTokenHandler(tokenStore, userStore, loginAttemptStore, revokedTokenStore, denylist, mail)
+	tokenHandler.AccessTokenTTL = cfg.AccessTokenTTL
+	tokenHandler.RefreshTokenTTL = cfg.RefreshTokenTTL
+	tokenHandler.PasswordResetTTL = cfg.PasswordResetTTL
+	tokenHandler.MFAPendingTTL = cfg.MFAPendingTTL
+	tokenHandler.JWTKeys = jwtKeys
+	adminHandler := api.NewAdminHandler(loginAttemptStore)
+	mfaHandler := api.NewMFAHandler(userStore, loginAttemptStore)
 
 	middlewareHandler := middleware.UserMiddleware{
-		UserStore: userStore,
+		UserStore:         userStore,
+		RequireActivation: cfg.RequireActivation,
+		JWTKeys:           jwtKeys,
+		Denylist:          denylist,
 	}
 
 	app := &Application{
-		Logger:       logger,
-		ListHandler:  listHandler,
-		UserHandler:  userHandler,
-		TokenHandler: tokenHandler,
-		Middleware:   middlewareHandler,
-		DB:           pgDB,
+		Config:              cfg,
+		Logger:              logger,
+		ListHandler:         listHandler,
+		ListEntryHandler:    listEntryHandler,
+		ListMemberHandler:   listMemberHandler,
+		ListRevisionHandler: listRevisionHandler,
+		UserHandler:         userHandler,
+		TokenHandler:        tokenHandler,
+		MFAHandler:          mfaHandler,
+		AdminHandler:        adminHandler,
+		Middleware:          middlewareHandler,
+		DB:                  pgDB,
+		listStore:           listStore,
+		revokedTokenStore:   revokedTokenStore,
+		denylist:            denylist,
 	}
 
+	// Emails are sent after the response; shutdown waits for them.
+	userHandler.Background = app.runWorker
+	tokenHandler.Background = app.runWorker
+
 	return app, nil
 }
 
+// newPasswordManager returns a manager hashing new passwords with the
+// configured algorithm.
+func newPasswordManager(cfg config.Passwords) *passwords.Manager {
+	if cfg.Hasher == "argon2id" {
+		params := passwords.DefaultArgon2id
+		params.Memory = uint32(cfg.Argon2Memory)
+		params.Iterations = uint32(cfg.Argon2Iterations)
+		params.Parallelism = uint8(cfg.Argon2Parallelism)
+		return passwords.NewManager(params)
+	}
+
+	return passwords.NewManager(passwords.BcryptHasher{Cost: cfg.BcryptCost})
+}
+
+// HealthCheck reports whether the server takes requests. Once Drain has been
+// called it responds with 503, so load balancers stop sending new requests.
 func (a *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	if a.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Status is draining\n")
+		return
+	}
+
 	fmt.Fprint(w, "Status is available\n")
 }
+
+// Drain marks the server as shutting down. From then on no new background
+// work is started.
+func (a *Application) Drain() {
+	a.workersMu.Lock()
+	defer a.workersMu.Unlock()
+
+	a.draining.Store(true)
+}
+
+// StartWorkers runs the background jobs until ctx is done. WaitWorkers waits
+// for them to stop.
+func (a *Application) StartWorkers(ctx context.Context) {
+	a.runWorker(func() {
+		a.PurgeTrash(ctx, a.Config.TrashRetention, a.Config.TrashPurgeInterval)
+	})
+
+	// Signing users out records revoked JWTs whether or not JWTs are issued,
+	// so the job also runs without them to delete the expired records.
+	a.runWorker(func() {
+		a.SyncRevokedTokens(ctx, a.Config.RevokedTokenSyncInterval)
+	})
+}
+
+// runWorker runs work in the background unless the server is draining, in
+// which case the work is dropped so WaitWorkers has nothing new to wait for.
+func (a *Application) runWorker(work func()) {
+	a.workersMu.Lock()
+	defer a.workersMu.Unlock()
+
+	if a.draining.Load() {
+		a.Logger.Warn("background work dropped while shutting down")
+		return
+	}
+
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		work()
+	}()
+}
+
+// WaitWorkers blocks until the jobs started by StartWorkers have stopped and
+// the background work of the handlers, such as sending email, has finished.
+// It must be called after Drain, and returns ctx's error if ctx is done
+// first.
+func (a *Application) WaitWorkers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PurgeTrash permanently deletes lists that have been in the trash for longer
+// than retention, checking again every interval until ctx is done.
+func (a *Application) PurgeTrash(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := a.listStore.PurgeDeletedLists(ctx, time.Now().Add(-retention))
+		if err != nil {
+			a.Logger.Error("purging trash failed", "op", "purgeDeletedLists", "error", err)
+		} else if purged > 0 {
+			a.Logger.Info("purged lists from the trash", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncRevokedTokens loads the access JWTs revoked by any server into the
+// denylist every interval and forgets the expired ones, until ctx is done.
+func (a *Application) SyncRevokedTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		revoked, err := a.revokedTokenStore.GetRevoked(ctx)
+		if err != nil {
+			a.Logger.Error("syncing revoked tokens failed", "op", "getRevoked", "error", err)
+		} else {
+			a.denylist.Sync(revoked, time.Now())
+		}
+
+		err = a.revokedTokenStore.DeleteExpired(ctx)
+		if err != nil {
+			a.Logger.Error("syncing revoked tokens failed", "op", "deleteExpired", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
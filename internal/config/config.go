@@ -0,0 +1,362 @@
+// Package config loads the server's settings. Each setting is a flag, which
+// can also be given as an environment variable named after it, e.g.
+// LIST_API_DB_DSN for -db-dsn, or in a config file. Flags take precedence
+// over environment variables, which take precedence over the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/passwords"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// EnvPrefix starts the names of the environment variables settings are read
+// from.
+const EnvPrefix = "LIST_API_"
+
+// DB configures the Postgres connection pool.
+type DB struct {
+	DSN          string
+	MaxOpenConns int
+	MaxIdleConns int
+	MaxIdleTime  time.Duration
+	QueryTimeout time.Duration
+}
+
+// SMTP configures outgoing email. Emails are written to MailFile, or stdout,
+// when Host is empty.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Sender   string
+	MailFile string
+}
+
+// Passwords configures how passwords are hashed and which are accepted.
+type Passwords struct {
+	Hasher            string
+	BcryptCost        int
+	Argon2Memory      uint
+	Argon2Iterations  uint
+	Argon2Parallelism uint
+	MinLength         int
+	BreachedFile      string
+}
+
+type Config struct {
+	Port            int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+	LogLevel        string
+	LogFormat       string
+	CORSOrigins     []string
+
+	DB        DB
+	SMTP      SMTP
+	Passwords Passwords
+
+	AccessTokenTTL   time.Duration
+	RefreshTokenTTL  time.Duration
+	PasswordResetTTL time.Duration
+	ActivationTTL    time.Duration
+	MFAPendingTTL    time.Duration
+
+	JWTKeyFile               string
+	RevokedTokenSyncInterval time.Duration
+
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+	RequireIfMatch     bool
+	RequireActivation  bool
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Port:            8080,
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		LogLevel:        "info",
+		LogFormat:       "text",
+		DB: DB{
+			DSN:          "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable",
+			MaxOpenConns: 25,
+			MaxIdleConns: 25,
+			MaxIdleTime:  15 * time.Minute,
+			QueryTimeout: 5 * time.Second,
+		},
+		SMTP: SMTP{
+			Port:   587,
+			Sender: "List API <no-reply@example.com>",
+		},
+		Passwords: Passwords{
+			Hasher:            "bcrypt",
+			BcryptCost:        12,
+			Argon2Memory:      uint(passwords.DefaultArgon2id.Memory),
+			Argon2Iterations:  uint(passwords.DefaultArgon2id.Iterations),
+			Argon2Parallelism: uint(passwords.DefaultArgon2id.Parallelism),
+			MinLength:         passwords.DefaultPolicy.MinLength,
+		},
+		AccessTokenTTL:           15 * time.Minute,
+		RefreshTokenTTL:          30 * 24 * time.Hour,
+		PasswordResetTTL:         45 * time.Minute,
+		ActivationTTL:            3 * 24 * time.Hour,
+		MFAPendingTTL:            5 * time.Minute,
+		RevokedTokenSyncInterval: 30 * time.Second,
+		TrashRetention:           30 * 24 * time.Hour,
+		TrashPurgeInterval:       time.Hour,
+	}
+}
+
+// listValue is a comma separated flag.
+type listValue struct {
+	list *[]string
+}
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(s string) error {
+	*v.list = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.list = append(*v.list, item)
+		}
+	}
+	return nil
+}
+
+func (c *Config) flagSet(configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("list-api", flag.ContinueOnError)
+
+	fs.StringVar(configFile, "config", "", "optional .env or YAML file to read settings from; defaults to .env if it exists")
+
+	fs.IntVar(&c.Port, "port", c.Port, "go backend server port")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long idle keep-alive connections are kept open")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "how long the health check reports draining before the server stops accepting connections on shutdown")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long in-flight requests and background work such as sending email get to finish on shutdown")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of logged messages: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of logged messages: text or json")
+	fs.Var(listValue{&c.CORSOrigins}, "cors-origins", "comma separated origins allowed to make cross-origin requests, or * for any")
+
+	fs.StringVar(&c.DB.DSN, "db-dsn", c.DB.DSN, "Postgres connection string")
+	fs.IntVar(&c.DB.MaxOpenConns, "db-max-open-conns", c.DB.MaxOpenConns, "maximum number of open database connections; 0 means unlimited")
+	fs.IntVar(&c.DB.MaxIdleConns, "db-max-idle-conns", c.DB.MaxIdleConns, "maximum number of idle database connections; capped at db-max-open-conns")
+	fs.DurationVar(&c.DB.MaxIdleTime, "db-max-idle-time", c.DB.MaxIdleTime, "how long a database connection may be idle before it is closed")
+	fs.DurationVar(&c.DB.QueryTimeout, "db-query-timeout", c.DB.QueryTimeout, "how long a single database operation may take before the request fails with 503; 0 means no limit")
+
+	fs.StringVar(&c.SMTP.Host, "smtp-host", c.SMTP.Host, "SMTP server used to send emails; emails are written to -mail-file when empty")
+	fs.IntVar(&c.SMTP.Port, "smtp-port", c.SMTP.Port, "SMTP server port")
+	fs.StringVar(&c.SMTP.Username, "smtp-username", c.SMTP.Username, "SMTP username")
+	fs.StringVar(&c.SMTP.Password, "smtp-password", c.SMTP.Password, "SMTP password")
+	fs.StringVar(&c.SMTP.Sender, "smtp-sender", c.SMTP.Sender, "sender address of outgoing emails")
+	fs.StringVar(&c.SMTP.MailFile, "mail-file", c.SMTP.MailFile, "file emails are appended to when no SMTP server is configured; defaults to stdout")
+
+	fs.StringVar(&c.Passwords.Hasher, "password-hasher", c.Passwords.Hasher, "algorithm new password hashes use: bcrypt or argon2id")
+	fs.IntVar(&c.Passwords.BcryptCost, "bcrypt-cost", c.Passwords.BcryptCost, "bcrypt cost factor")
+	fs.UintVar(&c.Passwords.Argon2Memory, "argon2-memory", c.Passwords.Argon2Memory, "argon2id memory in KiB")
+	fs.UintVar(&c.Passwords.Argon2Iterations, "argon2-iterations", c.Passwords.Argon2Iterations, "argon2id iterations")
+	fs.UintVar(&c.Passwords.Argon2Parallelism, "argon2-parallelism", c.Passwords.Argon2Parallelism, "argon2id parallelism")
+	fs.IntVar(&c.Passwords.MinLength, "password-min-length", c.Passwords.MinLength, "minimum length of new passwords")
+	fs.StringVar(&c.Passwords.BreachedFile, "breached-passwords", c.Passwords.BreachedFile, "file of breached passwords, one per line as plain text or SHA-1 hex, that new passwords may not be")
+
+	fs.DurationVar(&c.AccessTokenTTL, "access-token-ttl", c.AccessTokenTTL, "how long access tokens are valid")
+	fs.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", c.RefreshTokenTTL, "how long refresh tokens are valid")
+	fs.DurationVar(&c.PasswordResetTTL, "password-reset-ttl", c.PasswordResetTTL, "how long password reset tokens are valid")
+	fs.DurationVar(&c.ActivationTTL, "activation-ttl", c.ActivationTTL, "how long activation tokens are valid")
+	fs.DurationVar(&c.MFAPendingTTL, "mfa-pending-ttl", c.MFAPendingTTL, "how long users have to enter their second factor after their password")
+
+	fs.StringVar(&c.JWTKeyFile, "jwt-keys", c.JWTKeyFile, "file of keys to sign access tokens as JWTs with, one \"kid algorithm base64-key\" per line, newest first; access tokens are opaque when empty")
+	fs.DurationVar(&c.RevokedTokenSyncInterval, "revoked-token-sync-interval", c.RevokedTokenSyncInterval, "how often revoked JWTs are loaded from the database; JWTs revoked by signing out everywhere, changing the password or deleting the account stop working within this interval")
+
+	fs.DurationVar(&c.TrashRetention, "trash-retention", c.TrashRetention, "how long deleted lists stay in the trash")
+	fs.DurationVar(&c.TrashPurgeInterval, "trash-purge-interval", c.TrashPurgeInterval, "how often expired lists are purged from the trash")
+	fs.BoolVar(&c.RequireIfMatch, "require-if-match", c.RequireIfMatch, "reject list writes without an If-Match header")
+	fs.BoolVar(&c.RequireActivation, "require-activation", c.RequireActivation, "only let users with an activated account change data")
+
+	return fs
+}
+
+// EnvName returns the environment variable a flag can be set with.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load parses args, falling back to the environment and the config file for
+// settings not given as flags, and validates the result. Every invalid
+// setting is reported, not just the first.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	var configFile string
+	fs := cfg.flagSet(&configFile)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["config"] {
+		configFile = os.Getenv(EnvName("config"))
+	}
+
+	if configFile == "" && fileExists(defaultConfigFile) {
+		configFile = defaultConfigFile
+	}
+
+	fileValues, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for key := range fileValues {
+		if fs.Lookup(key) == nil || key == "config" {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", configFile, key))
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == "config" {
+			return
+		}
+
+		source := EnvName(f.Name)
+		value, ok := os.LookupEnv(source)
+		if !ok {
+			source = configFile + ": " + f.Name
+			value, ok = fileValues[f.Name]
+		}
+
+		if !ok {
+			return
+		}
+
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q: %w", source, value, err))
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the settings make sense together, returning an error
+// naming every setting that does not.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, name, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port", "must be between 1 and 65535")
+	check(c.ReadTimeout > 0, "read-timeout", "must be positive")
+	check(c.WriteTimeout > 0, "write-timeout", "must be positive")
+	check(c.IdleTimeout > 0, "idle-timeout", "must be positive")
+	check(c.DrainDelay >= 0, "drain-delay", "cannot be negative")
+	check(c.ShutdownTimeout > 0, "shutdown-timeout", "must be positive")
+	check(validLogLevel(c.LogLevel), "log-level", "must be debug, info, warn or error, got %q", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log-format", "must be text or json, got %q", c.LogFormat)
+
+	for _, origin := range c.CORSOrigins {
+		check(validOrigin(origin), "cors-origins", "%q is not * or an origin like https://example.com", origin)
+	}
+
+	check(c.DB.DSN != "", "db-dsn", "is required")
+	check(c.DB.MaxOpenConns >= 0, "db-max-open-conns", "cannot be negative")
+	check(c.DB.MaxIdleConns >= 0, "db-max-idle-conns", "cannot be negative")
+	check(c.DB.MaxIdleTime >= 0, "db-max-idle-time", "cannot be negative")
+	check(c.DB.QueryTimeout >= 0, "db-query-timeout", "cannot be negative")
+
+	if c.SMTP.Host != "" {
+		check(c.SMTP.Port > 0 && c.SMTP.Port <= 65535, "smtp-port", "must be between 1 and 65535")
+		check(c.SMTP.Sender != "", "smtp-sender", "is required when smtp-host is set")
+	}
+
+	switch c.Passwords.Hasher {
+	case "bcrypt":
+		check(c.Passwords.BcryptCost >= bcrypt.MinCost && c.Passwords.BcryptCost <= bcrypt.MaxCost,
+			"bcrypt-cost", "must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	case "argon2id":
+		check(c.Passwords.Argon2Memory > 0, "argon2-memory", "must be positive")
+		check(c.Passwords.Argon2Iterations > 0, "argon2-iterations", "must be positive")
+		check(c.Passwords.Argon2Parallelism > 0 && c.Passwords.Argon2Parallelism <= 255, "argon2-parallelism", "must be between 1 and 255")
+	default:
+		check(false, "password-hasher", "must be bcrypt or argon2id, got %q", c.Passwords.Hasher)
+	}
+	check(c.Passwords.MinLength > 0 && c.Passwords.MinLength <= passwords.DefaultPolicy.MaxLength,
+		"password-min-length", "must be between 1 and %d", passwords.DefaultPolicy.MaxLength)
+
+	check(c.AccessTokenTTL > 0, "access-token-ttl", "must be positive")
+	check(c.RefreshTokenTTL > c.AccessTokenTTL, "refresh-token-ttl", "must be longer than access-token-ttl")
+	check(c.PasswordResetTTL > 0, "password-reset-ttl", "must be positive")
+	check(c.ActivationTTL > 0, "activation-ttl", "must be positive")
+	check(c.MFAPendingTTL > 0, "mfa-pending-ttl", "must be positive")
+	check(c.RevokedTokenSyncInterval > 0, "revoked-token-sync-interval", "must be positive")
+
+	check(c.TrashRetention >= 0, "trash-retention", "cannot be negative")
+	check(c.TrashPurgeInterval > 0, "trash-purge-interval", "must be positive")
+
+	return errors.Join(errs...)
+}
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == ""
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	path := writeFile(t, "config.yaml", `
+port: 9000
+db-dsn: postgres://file
+db-max-open-conns: 10
+access-token-ttl: 5m
+cors-origins:
+  - https://a.example.com
+  - https://b.example.com
+`)
+
+	t.Setenv("LIST_API_CONFIG", path)
+	t.Setenv("LIST_API_DB_DSN", "postgres://env")
+	t.Setenv("LIST_API_PORT", "9001")
+
+	cfg, err := Load([]string{"-port", "9002"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 9002, cfg.Port, "flags win")
+	assert.Equal(t, "postgres://env", cfg.DB.DSN, "environment beats the file")
+	assert.Equal(t, 10, cfg.DB.MaxOpenConns)
+	assert.Equal(t, 5*time.Minute, cfg.AccessTokenTTL)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, cfg.CORSOrigins)
+	assert.Equal(t, 15*time.Minute, cfg.DB.MaxIdleTime, "unset settings keep their default")
+}
+
+func TestLoadDotEnv(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile(".env", []byte(`
+# read by default
+export LIST_API_LOG_LEVEL=debug
+LIST_API_SMTP_SENDER="Lists <lists@example.com>"
+POSTGRES_PASSWORD=ignored
+`), 0o600))
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, "Lists <lists@example.com>", cfg.SMTP.Sender)
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	path := writeFile(t, "config.yml", "port: eighty\nunknown-setting: 1\n")
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `port: invalid value "eighty"`)
+	assert.ErrorContains(t, err, `unknown setting "unknown-setting"`)
+
+	t.Setenv("LIST_API_BCRYPT_COST", "40")
+	_, err = Load([]string{"-log-level", "loud", "-log-format", "xml", "-cors-origins", "example.com", "-db-dsn", "", "-password-min-length", "100"})
+	require.Error(t, err)
+	for _, message := range []string{
+		`log-level: must be debug, info, warn or error, got "loud"`,
+		`log-format: must be text or json, got "xml"`,
+		`cors-origins: "example.com" is not * or an origin like https://example.com`,
+		"db-dsn: is required",
+		"bcrypt-cost: must be between 4 and 31",
+		"password-min-length: must be between 1 and 72",
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+
+	_, err = Load([]string{"-config", filepath.Join(t.TempDir(), "missing.env")})
+	assert.ErrorContains(t, err, "reading config file")
+}
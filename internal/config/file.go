@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read when no config file is given, if it exists.
+const defaultConfigFile = ".env"
+
+// readConfigFile returns the settings in a .env or YAML file, keyed by flag
+// name. YAML files, recognised by their .yaml or .yml extension, map flag
+// names to values, with lists for list settings. Any other file is read as a
+// .env file of environment variable assignments; variables without
+// EnvPrefix are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return parseYAML(path, content)
+	}
+
+	return parseDotEnv(path, content)
+}
+
+func parseYAML(path string, content []byte) (map[string]string, error) {
+	var raw map[string]any
+	err := yaml.Unmarshal(content, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	for key, value := range raw {
+		switch value := value.(type) {
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("%s: %s: nested settings are not supported", path, key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	return values, nil
+}
+
+func parseDotEnv(path string, content []byte) (map[string]string, error) {
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, line)
+		}
+
+		name = strings.TrimSpace(name)
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		values[flagName(name)] = value
+	}
+
+	return values, scanner.Err()
+}
+
+// flagName is the inverse of EnvName.
+func flagName(envName string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(envName, EnvPrefix), "_", "-"))
+}
+
+// fileExists reports whether path exists, so a missing default config file
+// can be skipped.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,421 @@
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// MergePatch applies an RFC 7396 merge patch to a decoded JSON document and
+// returns the result. Objects are merged recursively, null removes a member
+// and any other value, including arrays, replaces the target outright.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+
+		targetObject[key] = MergePatch(targetObject[key], value)
+	}
+
+	return targetObject
+}
+
+// Operation is a single RFC 6902 operation. HasValue distinguishes a missing
+// "value" member from an explicit null.
+type Operation struct {
+	Op       string
+	Path     string
+	From     string
+	Value    interface{}
+	HasValue bool
+}
+
+// OperationError reports why one operation of a patch could not be applied.
+type OperationError struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Err   string `json:"error"`
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op, e.Path, e.Err)
+}
+
+// Patch is an ordered list of RFC 6902 operations.
+type Patch []Operation
+
+// DecodePatch parses a JSON Patch document.
+func DecodePatch(data []byte) (Patch, error) {
+	var raw []map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.New("a JSON patch must be an array of operations")
+	}
+
+	patch := make(Patch, 0, len(raw))
+	for i, members := range raw {
+		var op Operation
+
+		for name, target := range map[string]*string{"op": &op.Op, "path": &op.Path, "from": &op.From} {
+			value, ok := members[name]
+			if !ok {
+				continue
+			}
+
+			err = json.Unmarshal(value, target)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %q must be a string", i, name)
+			}
+		}
+
+		if value, ok := members["value"]; ok {
+			op.HasValue = true
+			err = json.Unmarshal(value, &op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: invalid value", i)
+			}
+		}
+
+		patch = append(patch, op)
+	}
+
+	return patch, nil
+}
+
+// Validate checks the shape of every operation without applying any of them,
+// so all malformed operations can be reported together.
+func (p Patch) Validate() []*OperationError {
+	var errs []*OperationError
+
+	for i, op := range p {
+		fail := func(msg string) {
+			errs = append(errs, &OperationError{Index: i, Op: op.Op, Path: op.Path, Err: msg})
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if !op.HasValue {
+				fail("value is required")
+				continue
+			}
+		case "move", "copy":
+			_, err := ParsePointer(op.From)
+			if err != nil {
+				fail("from: " + err.Error())
+				continue
+			}
+		case "remove":
+		default:
+			fail("unknown operation")
+			continue
+		}
+
+		_, err := ParsePointer(op.Path)
+		if err != nil {
+			fail(err.Error())
+		}
+	}
+
+	return errs
+}
+
+// Apply runs the operations in order against a decoded JSON document and
+// returns the result. Application stops at the first failing operation.
+func (p Patch) Apply(doc interface{}) (interface{}, error) {
+	for i, op := range p {
+		var err error
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, &OperationError{Index: i, Op: op.Op, Path: op.Path, Err: err.Error()}
+		}
+	}
+
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op Operation) (interface{}, error) {
+	path, err := ParsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, deepCopy(op.Value))
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(op.Value))
+	case "move":
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "copy":
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+	case "test":
+		value, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+
+	return nil, errors.New("unknown operation")
+}
+
+// ParsePointer splits an RFC 6901 JSON pointer into unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func ParsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("path must be empty or start with /")
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+
+	if index > max {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+
+	return index, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("cannot traverse into %q", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// add inserts value at path, returning the possibly replaced document. Arrays
+// are rebuilt rather than modified in place, so the parent must be updated
+// with the new slice.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+
+		updated := make([]interface{}, 0, len(node)+1)
+		updated = append(updated, node[:index]...)
+		updated = append(updated, value)
+		updated = append(updated, node[index:]...)
+		return set(doc, path[:len(path)-1], updated)
+	}
+
+	return nil, fmt.Errorf("cannot add a member to a scalar")
+}
+
+// remove deletes the value at path and returns the document and the removed
+// value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %q does not exist", last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := node[index]
+		updated := make([]interface{}, 0, len(node)-1)
+		updated = append(updated, node[:index]...)
+		updated = append(updated, node[index+1:]...)
+		doc, err = set(doc, path[:len(path)-1], updated)
+		return doc, value, err
+	}
+
+	return nil, nil, fmt.Errorf("cannot remove a member from a scalar")
+}
+
+// set replaces the existing value at path.
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	}
+
+	return doc, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	}
+
+	return value
+}
+
+// ToDocument round-trips v through JSON so it can be patched generically.
+func ToDocument(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(js, &doc)
+	return doc, err
+}
+
+// FromDocument decodes a patched document into v, rejecting unknown fields.
+func FromDocument(doc interface{}, v interface{}) error {
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,127 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, js string) interface{} {
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(js), &v))
+	return v
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{name: "replace member", target: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "add member", target: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{name: "remove member", target: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{name: "arrays are replaced", target: `{"a":[1,2]}`, patch: `{"a":[3]}`, want: `{"a":[3]}`},
+		{name: "nested merge", target: `{"a":{"b":"c","d":"e"}}`, patch: `{"a":{"d":null,"f":"g"}}`, want: `{"a":{"b":"c","f":"g"}}`},
+		{name: "non object patch", target: `{"a":"b"}`, patch: `["c"]`, want: `["c"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergePatch(decode(t, tt.target), decode(t, tt.patch))
+			assert.Equal(t, decode(t, tt.want), got)
+		})
+	}
+}
+
+func TestPatchApply(t *testing.T) {
+	doc := `{"title":"List","entries":[{"title":"a"},{"title":"b"},{"title":"c"}]}`
+
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		wantErr int
+	}{
+		{
+			name:  "replace entry title",
+			patch: `[{"op":"replace","path":"/entries/1/title","value":"B"}]`,
+			want:  `{"title":"List","entries":[{"title":"a"},{"title":"B"},{"title":"c"}]}`,
+		},
+		{
+			name:  "append and remove",
+			patch: `[{"op":"add","path":"/entries/-","value":{"title":"d"}},{"op":"remove","path":"/entries/0"}]`,
+			want:  `{"title":"List","entries":[{"title":"b"},{"title":"c"},{"title":"d"}]}`,
+		},
+		{
+			name:  "move entry",
+			patch: `[{"op":"move","from":"/entries/0","path":"/entries/2"}]`,
+			want:  `{"title":"List","entries":[{"title":"b"},{"title":"c"},{"title":"a"}]}`,
+		},
+		{
+			name:  "copy entry",
+			patch: `[{"op":"copy","from":"/entries/2","path":"/entries/0"}]`,
+			want:  `{"title":"List","entries":[{"title":"c"},{"title":"a"},{"title":"b"},{"title":"c"}]}`,
+		},
+		{
+			name:  "test then replace",
+			patch: `[{"op":"test","path":"/title","value":"List"},{"op":"replace","path":"/title","value":"New"}]`,
+			want:  `{"title":"New","entries":[{"title":"a"},{"title":"b"},{"title":"c"}]}`,
+		},
+		{
+			name:    "failed test",
+			patch:   `[{"op":"replace","path":"/title","value":"New"},{"op":"test","path":"/title","value":"List"}]`,
+			wantErr: 1,
+		},
+		{
+			name:    "index out of range",
+			patch:   `[{"op":"replace","path":"/entries/3/title","value":"x"}]`,
+			wantErr: 0,
+		},
+		{
+			name:  "escaped pointer",
+			patch: `[{"op":"add","path":"/a~1b~0c","value":1}]`,
+			want:  `{"title":"List","a/b~c":1,"entries":[{"title":"a"},{"title":"b"},{"title":"c"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := DecodePatch([]byte(tt.patch))
+			require.NoError(t, err)
+			require.Empty(t, patch.Validate())
+
+			got, err := patch.Apply(decode(t, doc))
+			if tt.want == "" {
+				var opErr *OperationError
+				require.ErrorAs(t, err, &opErr)
+				assert.Equal(t, tt.wantErr, opErr.Index)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, decode(t, tt.want), got)
+		})
+	}
+}
+
+func TestPatchValidate(t *testing.T) {
+	patch, err := DecodePatch([]byte(`[
+		{"op":"add","path":"/a"},
+		{"op":"replace","path":"/a","value":null},
+		{"op":"jump","path":"/a"},
+		{"op":"remove","path":"a"},
+		{"op":"move","from":"a","path":"/b"}
+	]`))
+	require.NoError(t, err)
+
+	errs := patch.Validate()
+	require.Len(t, errs, 4)
+	assert.Equal(t, 0, errs[0].Index)
+	assert.Equal(t, 2, errs[1].Index)
+	assert.Equal(t, 3, errs[2].Index)
+	assert.Equal(t, 4, errs[3].Index)
+}
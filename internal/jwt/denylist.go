@@ -0,0 +1,51 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// Denylist holds the IDs of revoked tokens that have not expired yet, so
+// checking a token needs no database query. It is safe for concurrent use.
+type Denylist struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewDenylist() *Denylist {
+	return &Denylist{revoked: map[string]time.Time{}}
+}
+
+// Add revokes the token with id until it expires.
+func (d *Denylist) Add(id string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.revoked[id] = expiry
+}
+
+// Contains reports whether the token with id has been revoked.
+func (d *Denylist) Contains(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.revoked[id]
+	return ok
+}
+
+// Sync adds revoked, typically the revocations stored in the database by
+// every server, and forgets tokens that have expired by now.
+func (d *Denylist) Sync(revoked map[string]time.Time, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, expiry := range revoked {
+		d.revoked[id] = expiry
+	}
+
+	for id, expiry := range d.revoked {
+		if !now.Before(expiry) {
+			delete(d.revoked, id)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Package jwt signs and verifies the JSON Web Tokens used as stateless access
+// tokens. Only EdDSA (Ed25519) and HS256 are supported.
+package jwt
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a signing key identified by its kid. EdDSA keys hold an Ed25519
+// private key, HS256 keys a shared secret.
+type Key struct {
+	ID        string
+	Algorithm string
+	private   ed25519.PrivateKey
+	secret    []byte
+}
+
+func NewEd25519Key(id string, private ed25519.PrivateKey) *Key {
+	return &Key{ID: id, Algorithm: AlgEdDSA, private: private}
+}
+
+func NewHS256Key(id string, secret []byte) *Key {
+	return &Key{ID: id, Algorithm: AlgHS256, secret: secret}
+}
+
+// GenerateEd25519Key returns a new random EdDSA key.
+func GenerateEd25519Key(id string) (*Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEd25519Key(id, private), nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == AlgEdDSA {
+		return ed25519.Sign(k.private, input)
+	}
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == AlgEdDSA {
+		return ed25519.Verify(k.private.Public().(ed25519.PublicKey), input, signature)
+	}
+
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// Claims is the payload of an access token. Subject is the user ID and
+// Username the user's name when the token was issued.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Username  string `json:"preferred_username,omitempty"`
+	Scope     string `json:"scope"`
+	Activated bool   `json:"activated,omitempty"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Expiry returns when the token stops being valid.
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// KeySet signs tokens with its newest key and verifies tokens signed with any
+// of its keys. Rotating keys means adding a new signing key and keeping the
+// old one until the tokens it signed have expired.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet returns a key set that signs with signing and also accepts
+// tokens signed with retired.
+func NewKeySet(signing *Key, retired ...*Key) *KeySet {
+	keys := map[string]*Key{signing.ID: signing}
+	for _, key := range retired {
+		keys[key.ID] = key
+	}
+
+	return &KeySet{signing: signing, keys: keys}
+}
+
+// Sign returns claims as a signed compact JWT.
+func (s *KeySet) Sign(claims Claims) (string, error) {
+	headerJSON, err := json.Marshal(header{Algorithm: s.signing.Algorithm, Type: "JWT", KeyID: s.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	signature := s.signing.sign([]byte(input))
+
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature against the key named by its kid and
+// returns its claims. It returns ErrExpiredToken if the token expired before
+// now and ErrInvalidToken for anything else that is wrong with it.
+func (s *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	err := decodePart(parts[0], &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := s.keys[h.KeyID]
+	if !ok || key.Algorithm != h.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = decodePart(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !now.Before(claims.Expiry()) {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+func decodePart(part string, v any) error {
+	decoded, err := encoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// JWK is the public half of an EdDSA key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS returns the public keys of the set. HS256 keys are secret and left
+// out, so tokens signed with them can only be verified by this server.
+func (s *KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, key := range s.keys {
+		if key.Algorithm != AlgEdDSA {
+			continue
+		}
+
+		jwks = append(jwks, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(key.private.Public().(ed25519.PublicKey)),
+			KeyID:     key.ID,
+			Algorithm: AlgEdDSA,
+			Use:       "sig",
+		})
+	}
+
+	return jwks
+}
+
+// LoadKeySet reads keys from a file with one "kid algorithm key" line per
+// key, where key is the base64 encoded 32 byte Ed25519 seed for EdDSA or the
+// base64 encoded secret for HS256, e.g. from openssl rand -base64 32. The
+// first key signs new tokens. Blank lines and lines starting with # are
+// skipped.
+func LoadKeySet(path string) (*KeySet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []*Key
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := parseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if seen[key.ID] {
+			return nil, fmt.Errorf("%s:%d: duplicate kid %q", path, line, key.ID)
+		}
+		seen[key.ID] = true
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return NewKeySet(keys[0], keys[1:]...), nil
+}
+
+func parseKey(line string) (*Key, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, errors.New("expected kid, algorithm and key")
+	}
+
+	material, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %w", err)
+	}
+
+	switch fields[1] {
+	case AlgEdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("EdDSA keys must be %d bytes", ed25519.SeedSize)
+		}
+		return NewEd25519Key(fields[0], ed25519.NewKeyFromSeed(material)), nil
+	case AlgHS256:
+		if len(material) < 32 {
+			return nil, errors.New("HS256 secrets must be at least 32 bytes")
+		}
+		return NewHS256Key(fields[0], material), nil
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %q", fields[1])
+}
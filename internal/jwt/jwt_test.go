@@ -0,0 +1,142 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClaims(now time.Time) Claims {
+	return Claims{
+		Subject:   "42",
+		Username:  "alice",
+		Scope:     "authentication",
+		ID:        "session",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(15 * time.Minute).Unix(),
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	edKey, err := GenerateEd25519Key("ed")
+	require.NoError(t, err)
+
+	keys := map[string]*Key{
+		AlgEdDSA: edKey,
+		AlgHS256: NewHS256Key("hs", []byte(strings.Repeat("s", 32))),
+	}
+
+	now := time.Now()
+	for alg, key := range keys {
+		t.Run(alg, func(t *testing.T) {
+			set := NewKeySet(key)
+
+			token, err := set.Sign(testClaims(now))
+			require.NoError(t, err)
+
+			claims, err := set.Verify(token, now)
+			require.NoError(t, err)
+			assert.Equal(t, testClaims(now), *claims)
+
+			_, err = set.Verify(token, now.Add(time.Hour))
+			assert.ErrorIs(t, err, ErrExpiredToken)
+
+			parts := strings.Split(token, ".")
+			forged := encoding.EncodeToString([]byte(`{"sub":"1","scope":"authentication","jti":"x","iat":0,"exp":9999999999}`))
+			_, err = set.Verify(parts[0]+"."+forged+"."+parts[2], now)
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestVerifyRejectsUnknownKeysAndAlgorithms(t *testing.T) {
+	now := time.Now()
+	secret := []byte(strings.Repeat("s", 32))
+
+	signing, err := GenerateEd25519Key("current")
+	require.NoError(t, err)
+
+	token, err := NewKeySet(NewHS256Key("other", secret)).Sign(testClaims(now))
+	require.NoError(t, err)
+	_, err = NewKeySet(signing).Verify(token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken, "unknown kid")
+
+	token, err = NewKeySet(NewHS256Key("current", secret)).Sign(testClaims(now))
+	require.NoError(t, err)
+	_, err = NewKeySet(signing).Verify(token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken, "alg does not match the key")
+
+	_, err = NewKeySet(signing).Verify("not-a-jwt", now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+
+	old, err := GenerateEd25519Key("2026-04")
+	require.NoError(t, err)
+	token, err := NewKeySet(old).Sign(testClaims(now))
+	require.NoError(t, err)
+
+	current, err := GenerateEd25519Key("2026-10")
+	require.NoError(t, err)
+	rotated := NewKeySet(current, old)
+
+	_, err = rotated.Verify(token, now)
+	assert.NoError(t, err, "tokens signed with a retired key stay valid")
+
+	newToken, err := rotated.Sign(testClaims(now))
+	require.NoError(t, err)
+	_, err = NewKeySet(old).Verify(newToken, now)
+	assert.ErrorIs(t, err, ErrInvalidToken, "new tokens are signed with the current key")
+
+	jwks := rotated.JWKS()
+	assert.Len(t, jwks, 2)
+	for _, jwk := range jwks {
+		assert.Equal(t, "OKP", jwk.KeyType)
+		assert.Equal(t, AlgEdDSA, jwk.Algorithm)
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	secret := []byte(strings.Repeat("s", 32))
+
+	content := "# newest first\n" +
+		"b EdDSA " + base64.StdEncoding.EncodeToString(seed) + "\n\n" +
+		"a HS256 " + base64.StdEncoding.EncodeToString(secret) + "\n"
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	set, err := LoadKeySet(path)
+	require.NoError(t, err)
+	assert.Equal(t, "b", set.signing.ID)
+	assert.Len(t, set.keys, 2)
+	assert.Len(t, set.JWKS(), 1, "HS256 secrets are not published")
+
+	require.NoError(t, os.WriteFile(path, []byte("a HS256 c2hvcnQ=\n"), 0o600))
+	_, err = LoadKeySet(path)
+	assert.ErrorContains(t, err, "at least 32 bytes")
+}
+
+func TestDenylist(t *testing.T) {
+	now := time.Now()
+	denylist := NewDenylist()
+
+	denylist.Add("local", now.Add(time.Minute))
+	denylist.Sync(map[string]time.Time{"remote": now.Add(time.Minute), "old": now.Add(-time.Minute)}, now)
+
+	assert.True(t, denylist.Contains("local"))
+	assert.True(t, denylist.Contains("remote"))
+	assert.False(t, denylist.Contains("old"))
+
+	denylist.Sync(nil, now.Add(2*time.Minute))
+	assert.False(t, denylist.Contains("local"))
+}
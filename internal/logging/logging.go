@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// New returns a logger writing records at level and above to w, as JSON
+// lines when format is "json" and as key=value pairs when it is "text".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+type contextKey struct{}
+
+// requestLogger is shared by every context derived from the one a request
+// started with, so attributes added deep in the handler chain are seen by the
+// middleware that logs the finished request.
+type requestLogger struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// NewContext returns a copy of ctx carrying logger as its request-scoped
+// logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestLogger{logger: logger})
+}
+
+// FromContext returns the request-scoped logger of ctx, or the default
+// logger if ctx has none.
+func FromContext(ctx context.Context) *slog.Logger {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return slog.Default()
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.logger
+}
+
+// With adds attributes to the request-scoped logger of ctx. Unlike
+// NewContext it changes the logger for the whole request, including callers
+// holding a parent context. It does nothing if ctx has no logger.
+func With(ctx context.Context, args ...any) {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.logger = rl.logger.With(args...)
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "warn")
+	require.NoError(t, err)
+
+	logger.Info("skipped")
+	logger.Warn("kept", "op", "getList")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "kept", record["msg"])
+	assert.Equal(t, "getList", record["op"])
+
+	_, err = New(&buf, "xml", "info")
+	assert.ErrorContains(t, err, "invalid log format")
+	_, err = New(&buf, "text", "loud")
+	assert.ErrorContains(t, err, "invalid log level")
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", "info")
+	require.NoError(t, err)
+
+	ctx := NewContext(context.Background(), logger.With("request_id", "abc"))
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	With(child, "user_id", 7)
+	FromContext(ctx).Info("done")
+
+	assert.Contains(t, buf.String(), "request_id=abc user_id=7")
+
+	With(context.Background(), "ignored", true)
+	assert.NotNil(t, FromContext(context.Background()))
+}
@@ -0,0 +1,133 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts a single SMTP session and reports the message it
+// received.
+func fakeSMTPServer(t *testing.T) (string, <-chan fakeMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	messages := make(chan fakeMessage, 1)
+
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		var msg fakeMessage
+		reply("220 localhost ESMTP")
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			command := strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				msg.from = strings.TrimSuffix(strings.TrimPrefix(command, "MAIL FROM:<"), ">")
+				reply("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.TrimSuffix(strings.TrimPrefix(command, "RCPT TO:<"), ">"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+
+				msg.data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				messages <- msg
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	m := NewSMTPMailer(host, portNumber, "", "", "List API <noreply@example.com>")
+	err = m.Send("user@example.com", "Reset your password", "Your token is ABC\nThanks")
+	require.NoError(t, err)
+
+	msg := <-messages
+	assert.Equal(t, "noreply@example.com", msg.from)
+	assert.Equal(t, []string{"user@example.com"}, msg.to)
+	assert.Contains(t, msg.data, "From: List API <noreply@example.com>\r\n")
+	assert.Contains(t, msg.data, "Subject: Reset your password\r\n")
+	assert.Contains(t, msg.data, "To: user@example.com\r\n")
+	assert.Contains(t, msg.data, "\r\n\r\nYour token is ABC\r\nThanks\r\n")
+}
+
+func TestMailersRejectHeaderInjection(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := NewLogMailer(&buf).Send("user@example.com\r\nBcc: other@example.com", "Subject", "Body")
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.Empty(t, buf.String())
+
+	err = NewSMTPMailer("127.0.0.1", 25, "", "", "noreply@example.com").Send("user@example.com", "Hi\nBcc: x", "Body")
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := NewLogMailer(&buf).Send("user@example.com", "Hello", "Body")
+	require.NoError(t, err)
+	assert.Equal(t, "To: user@example.com\nSubject: Hello\n\nBody\n\n", buf.String())
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	teapot := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := CORS([]string{"https://app.example.com"})(teapot)
+
+	serve := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/lists", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodGet, "https://app.example.com", nil)
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = serve(http.MethodOptions, "https://app.example.com", map[string]string{"Access-Control-Request-Method": "PATCH"})
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), "PATCH")
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	rr = serve(http.MethodGet, "https://evil.example.com", nil)
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = serve(http.MethodOptions, "https://evil.example.com", map[string]string{"Access-Control-Request-Method": "PATCH"})
+	assert.Equal(t, http.StatusTeapot, rr.Code, "preflights from other origins are not answered")
+
+	wildcard := CORS([]string{"*"})(teapot)
+	req := httptest.NewRequest(http.MethodGet, "/lists", nil)
+	req.Header.Set("Origin", "https://elsewhere.example.com")
+	rr = httptest.NewRecorder()
+	wildcard.ServeHTTP(rr, req)
+	assert.Equal(t, "https://elsewhere.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+}
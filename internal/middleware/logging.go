@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+)
+
+// maxRequestIDLength bounds the client supplied IDs that are accepted.
+const maxRequestIDLength = 128
+
+// RequestID gives every request an ID, taken from the X-Request-ID header if
+// the client sent a usable one and generated otherwise. The ID is stored in
+// the request's context and echoed in the response header, from where
+// utils.WriteJSON adds it to error envelopes.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(utils.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(utils.RequestIDHeader, id)
+		next.ServeHTTP(w, SetRequestID(r, id))
+	})
+}
+
+// validRequestID accepts IDs made of letters, digits and the punctuation
+// found in UUIDs and similar formats, so they are safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestLogger gives every request a logger derived from base that records
+// the request ID, the method and the path. Handlers get the logger with
+// logging.FromContext; Authenticate adds the user to it. Once the request has
+// been served it writes the access log line, with the status, the size of the
+// body and the duration. It must run after RequestID.
+func RequestLogger(base *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			logger := base.With("request_id", GetRequestID(r), "method", r.Method, "path", r.URL.Path)
+			ctx := logging.NewContext(r.Context(), logger)
+
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			logging.FromContext(ctx).Info("request completed",
+				"status", rw.status, "bytes", rw.bytes, "duration", time.Since(start))
+		})
+	}
+}
+
+// responseWriter records the status and body size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
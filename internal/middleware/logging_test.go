@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/mikemcavoydev/list-api/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = GetRequestID(r)
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "list not found"})
+	}))
+
+	serve := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/lists/1", nil)
+		if id != "" {
+			req.Header.Set(utils.RequestIDHeader, id)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("3f2b9c1e-client")
+	assert.Equal(t, "3f2b9c1e-client", seen)
+	assert.Equal(t, "3f2b9c1e-client", rr.Header().Get(utils.RequestIDHeader))
+	assert.Contains(t, rr.Body.String(), `"request_id": "3f2b9c1e-client"`)
+
+	for _, id := range []string{"", "has spaces", "line\nbreak", strings.Repeat("a", maxRequestIDLength+1)} {
+		rr = serve(id)
+		assert.Len(t, seen, 16, "generated for %q", id)
+		assert.Equal(t, seen, rr.Header().Get(utils.RequestIDHeader))
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&logs, nil))
+
+	handler := RequestID(RequestLogger(base)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.With(r.Context(), "user_id", 3, "username", "alice")
+		logging.FromContext(r.Context()).Warn("handled")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/lists", nil)
+	req.Header.Set(utils.RequestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, line, "request_id=abc method=POST path=/lists user_id=3 username=alice")
+	}
+	assert.Contains(t, lines[1], `msg="request completed"`)
+	assert.Contains(t, lines[1], "status=201 bytes=5 duration=")
+}
@@ -2,21 +2,52 @@ package middleware
 
 import (
 	"context"
+	"encoding/base64"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mikemcavoydev/list-api/internal/jwt"
+	"github.com/mikemcavoydev/list-api/internal/logging"
 	"github.com/mikemcavoydev/list-api/internal/store"
 	"github.com/mikemcavoydev/list-api/internal/tokens"
 	"github.com/mikemcavoydev/list-api/internal/utils"
 )
 
+// UserMiddleware authenticates requests. When RequireActivation is set,
+// RequireActivatedUser also rejects users who have not verified their email.
+// When JWTKeys is set, access JWTs signed with them are accepted without a
+// database query unless their ID is in Denylist.
 type UserMiddleware struct {
-	UserStore store.UserStore
+	UserStore         store.UserStore
+	RequireActivation bool
+	JWTKeys           *jwt.KeySet
+	Denylist          *jwt.Denylist
 }
 
 type contextKey string
 
-const UserContextKey = contextKey("user")
+const (
+	UserContextKey        = contextKey("user")
+	TokenContextKey       = contextKey("token")
+	PermissionsContextKey = contextKey("permissions")
+	ClaimsContextKey      = contextKey("claims")
+	RequestIDContextKey   = contextKey("request_id")
+)
+
+// SetRequestID records the ID the request is logged under.
+func SetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), RequestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// GetRequestID returns the ID of the request, or "" if it did not pass
+// through RequestID.
+func GetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(RequestIDContextKey).(string)
+	return id
+}
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	ctx := context.WithValue(r.Context(), UserContextKey, user)
@@ -31,6 +62,47 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+// SetTokenHash records the hash of the token the request authenticated with.
+func SetTokenHash(r *http.Request, hash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), TokenContextKey, hash)
+	return r.WithContext(ctx)
+}
+
+// GetTokenHash returns the hash of the token the request authenticated with,
+// or nil for anonymous requests.
+func GetTokenHash(r *http.Request) []byte {
+	hash, _ := r.Context().Value(TokenContextKey).([]byte)
+	return hash
+}
+
+// SetPermissions records the permissions of the personal access token the
+// request authenticated with.
+func SetPermissions(r *http.Request, permissions []string) *http.Request {
+	ctx := context.WithValue(r.Context(), PermissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// GetPermissions returns the permissions of the personal access token the
+// request authenticated with, or nil if the request is not limited.
+func GetPermissions(r *http.Request) []string {
+	permissions, _ := r.Context().Value(PermissionsContextKey).([]string)
+	return permissions
+}
+
+// SetClaims records the claims of the access JWT the request authenticated
+// with.
+func SetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), ClaimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// GetClaims returns the claims of the access JWT the request authenticated
+// with, or nil if it did not use one.
+func GetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(ClaimsContextKey).(*jwt.Claims)
+	return claims
+}
+
 func (m *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -48,9 +120,14 @@ func (m *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
-		user, err := m.UserStore.GetUserToken(tokens.ScopeAuth, token)
+		if m.JWTKeys != nil && strings.Count(token, ".") == 2 {
+			m.authenticateJWT(w, r, next, token)
+			return
+		}
+
+		user, permissions, err := m.UserStore.GetUserByAccessToken(r.Context(), token)
 		if err != nil {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid token"})
+			utils.WriteServerError(w, r, "getUserByAccessToken", err, "internal server error")
 			return
 		}
 
@@ -59,11 +136,73 @@ func (m *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		logging.With(r.Context(), "user_id", user.ID, "username", user.Username)
+
 		r = SetUser(r, user)
+		r = SetTokenHash(r, tokens.Hash(token))
+		r = SetPermissions(r, permissions)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateJWT authenticates a request from the claims of an access JWT
+// alone. The user it sets only has the ID and activation state the token was
+// issued with; LoadUser fetches the rest.
+func (m *UserMiddleware) authenticateJWT(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := m.JWTKeys.Verify(token, time.Now())
+	if err != nil || claims.Scope != tokens.ScopeAuth || m.Denylist.Contains(claims.ID) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "token expired or invalid"})
+		return
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid token"})
+		return
+	}
+
+	// The token ID is the hash of the session's stored token, so session
+	// management works the same as for opaque tokens.
+	hash, err := base64.RawURLEncoding.DecodeString(claims.ID)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid token"})
+		return
+	}
+
+	logging.With(r.Context(), "user_id", userID, "username", claims.Username)
+
+	r = SetUser(r, &store.User{ID: userID, Username: claims.Username, Activated: claims.Activated})
+	r = SetTokenHash(r, hash)
+	r = SetClaims(r, claims)
+	next.ServeHTTP(w, r)
+}
+
+// LoadUser replaces the partial user of a request authenticated with an
+// access JWT with the stored user, for routes that need more than its ID.
+// Other requests pass through unchanged.
+func (m *UserMiddleware) LoadUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaims(r)
+		if claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := m.UserStore.GetUserByID(r.Context(), GetUser(r).ID)
+		if err != nil {
+			utils.WriteServerError(w, r, "getUserByID", err, "internal server error")
+			return
+		}
+
+		if user == nil {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "token expired or invalid"})
+			return
+		}
+
+		next.ServeHTTP(w, SetUser(r, user))
+	})
+}
+
 func (m *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := GetUser(r)
@@ -76,3 +215,45 @@ func (m *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireActivatedUser is RequireUser for routes that change data. If
+// RequireActivation is set, users must also have activated their account.
+func (m *UserMiddleware) RequireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return m.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r)
+
+		if m.RequireActivation && !user.Activated {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account must be activated to access this route"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin only lets admins through.
+func (m *UserMiddleware) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return m.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !GetUser(r).Admin {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you must be an admin to access this route"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope rejects requests made with a personal access token that was
+// not granted permission. Other requests pass through unchanged.
+func (m *UserMiddleware) RequireScope(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !tokens.HasPermission(GetPermissions(r), permission) {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "token is missing the " + permission + " scope"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher hashes passwords into self-describing encoded strings that record
+// the algorithm and parameters used.
+type Hasher interface {
+	// Hash returns the encoded hash of plaintext.
+	Hash(plaintext string) (string, error)
+	// Verify reports whether plaintext matches encoded.
+	Verify(plaintext, encoded string) (bool, error)
+	// Handles reports whether encoded was produced by this algorithm.
+	Handles(encoded string) bool
+	// Current reports whether encoded uses this hasher's parameters.
+	Current(encoded string) bool
+}
+
+// BcryptMaxBytes is the length in bytes of the longest password bcrypt
+// hashes.
+const BcryptMaxBytes = 72
+
+// BcryptHasher hashes with bcrypt at Cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Verify(plaintext, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plaintext))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (h BcryptHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == h.Cost
+}
+
+// Argon2idHasher hashes with argon2id and encodes hashes in the PHC string
+// format, e.g. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. Memory is in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id uses 64 MiB of memory, three iterations and two lanes.
+var DefaultArgon2id = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h Argon2idHasher) Hash(plaintext string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodeArgon2id(encoded string) (*argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, ErrUnknownHash
+	}
+
+	params := &argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil {
+		return nil, ErrUnknownHash
+	}
+
+	params.salt, err = phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrUnknownHash
+	}
+
+	params.key, err = phcEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return nil, ErrUnknownHash
+	}
+
+	return params, nil
+}
+
+func (h Argon2idHasher) Verify(plaintext, encoded string) (bool, error) {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h Argon2idHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h Argon2idHasher) Current(encoded string) bool {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false
+	}
+
+	return params.memory == h.Memory &&
+		params.iterations == h.Iterations &&
+		params.parallelism == h.Parallelism &&
+		uint32(len(params.salt)) == h.SaltLength &&
+		uint32(len(params.key)) == h.KeyLength
+}
+
+// Manager hashes new passwords with Current and verifies hashes made by any
+// of the supported algorithms, so the algorithm or its parameters can change
+// without invalidating existing passwords.
+type Manager struct {
+	Current Hasher
+	hashers []Hasher
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func NewManager(current Hasher) *Manager {
+	return &Manager{
+		Current: current,
+		hashers: []Hasher{current, BcryptHasher{}, Argon2idHasher{}},
+	}
+}
+
+func (m *Manager) Hash(plaintext string) (string, error) {
+	return m.Current.Hash(plaintext)
+}
+
+func (m *Manager) Verify(plaintext, encoded string) (bool, error) {
+	for _, hasher := range m.hashers {
+		if hasher.Handles(encoded) {
+			return hasher.Verify(plaintext, encoded)
+		}
+	}
+
+	return false, ErrUnknownHash
+}
+
+// NeedsRehash reports whether encoded should be replaced with a hash from the
+// current hasher.
+func (m *Manager) NeedsRehash(encoded string) bool {
+	return !m.Current.Handles(encoded) || !m.Current.Current(encoded)
+}
+
+// DummyVerify takes as long as verifying a password hashed by the current
+// hasher, for requests that have no real hash to check.
+func (m *Manager) DummyVerify(plaintext string) {
+	m.dummyOnce.Do(func() {
+		m.dummyHash, _ = m.Current.Hash("dummy-password-for-timing")
+	})
+
+	m.Current.Verify(plaintext, m.dummyHash)
+}
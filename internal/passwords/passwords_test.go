@@ -0,0 +1,98 @@
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cheapArgon2id keeps the tests fast.
+var cheapArgon2id = Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashers(t *testing.T) {
+	hashers := map[string]Hasher{
+		"bcrypt":   BcryptHasher{Cost: 4},
+		"argon2id": cheapArgon2id,
+	}
+
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash("correct horse")
+			require.NoError(t, err)
+			assert.True(t, hasher.Handles(encoded))
+			assert.True(t, hasher.Current(encoded))
+
+			ok, err := hasher.Verify("correct horse", encoded)
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = hasher.Verify("wrong horse", encoded)
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	encoded, err := cheapArgon2id.Hash("password")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	stronger := cheapArgon2id
+	stronger.Iterations = 2
+	assert.False(t, stronger.Current(encoded))
+
+	_, err = cheapArgon2id.Verify("password", "$argon2id$v=19$m=1024$salt$key")
+	assert.ErrorIs(t, err, ErrUnknownHash)
+}
+
+func TestManagerRehash(t *testing.T) {
+	legacy := NewManager(BcryptHasher{Cost: 4})
+	encoded, err := legacy.Hash("password")
+	require.NoError(t, err)
+	assert.False(t, legacy.NeedsRehash(encoded))
+
+	upgraded := NewManager(BcryptHasher{Cost: 5})
+	assert.True(t, upgraded.NeedsRehash(encoded))
+
+	migrated := NewManager(cheapArgon2id)
+	assert.True(t, migrated.NeedsRehash(encoded))
+
+	ok, err := migrated.Verify("password", encoded)
+	require.NoError(t, err)
+	assert.True(t, ok, "hashes from the previous algorithm still verify")
+
+	rehashed, err := migrated.Hash("password")
+	require.NoError(t, err)
+	assert.False(t, migrated.NeedsRehash(rehashed))
+
+	_, err = migrated.Verify("password", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownHash)
+}
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	content := "# common passwords\npassword123\n\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	breached, err := LoadBreached(path)
+	require.NoError(t, err)
+	assert.Len(t, breached, 2)
+
+	policy := Policy{MinLength: 8, MaxLength: 20, Breached: breached}
+
+	assert.NoError(t, policy.Validate("a perfectly fine one"))
+	assert.EqualError(t, policy.Validate("short"), "password must be at least 8 characters")
+	assert.EqualError(t, policy.Validate(strings.Repeat("x", 21)), "password cannot be greater than 20 characters")
+	assert.ErrorIs(t, policy.Validate("password123"), ErrBreachedPassword)
+
+	emoji := strings.Repeat("🔑", 20)
+	assert.NoError(t, policy.Validate(emoji), "lengths count characters")
+	assert.EqualError(t, DefaultPolicy.Validate(emoji), "password cannot be greater than 72 bytes")
+	assert.NoError(t, DefaultPolicy.Validate(strings.Repeat("鍵", 24)))
+	assert.ErrorIs(t, policy.Validate("password"), ErrBreachedPassword, "matches the SHA-1 entry")
+}
@@ -0,0 +1,102 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrBreachedPassword = errors.New("password appears in a list of breached passwords, please choose another")
+
+// Policy is what new passwords have to satisfy. Lengths count characters,
+// except MaxBytes, which bounds the UTF-8 encoding for hashers that limit
+// their input in bytes. Breached holds known-breached passwords, either in
+// plain text or as lowercase SHA-1 hex digests.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	MaxBytes  int
+	Breached  map[string]struct{}
+}
+
+// DefaultPolicy requires at least 8 characters. The maximum of 72 bytes keeps
+// passwords within what bcrypt hashes; a password of 72 characters outside
+// ASCII is longer than that.
+var DefaultPolicy = Policy{
+	MinLength: 8,
+	MaxLength: 72,
+	MaxBytes:  BcryptMaxBytes,
+}
+
+// LoadBreached reads a breached-password list with one entry per line, as
+// plain text or SHA-1 hex digests. Blank lines and lines starting with # are
+// skipped.
+func LoadBreached(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := map[string]struct{}{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if isSHA1Hex(line) {
+			line = strings.ToLower(line)
+		}
+
+		breached[line] = struct{}{}
+	}
+
+	return breached, scanner.Err()
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Validate returns an error describing why plaintext does not satisfy the
+// policy, or nil if it does.
+func (p Policy) Validate(plaintext string) error {
+	length := utf8.RuneCountInString(plaintext)
+
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password cannot be greater than %d characters", p.MaxLength)
+	}
+
+	if p.MaxBytes > 0 && len(plaintext) > p.MaxBytes {
+		return fmt.Errorf("password cannot be greater than %d bytes", p.MaxBytes)
+	}
+
+	if len(p.Breached) > 0 {
+		digest := sha1.Sum([]byte(plaintext))
+
+		_, plain := p.Breached[plaintext]
+		_, hashed := p.Breached[hex.EncodeToString(digest[:])]
+		if plain || hashed {
+			return ErrBreachedPassword
+		}
+	}
+
+	return nil
+}
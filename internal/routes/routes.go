@@ -3,25 +3,98 @@ package routes
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/mikemcavoydev/list-api/internal/app"
+	"github.com/mikemcavoydev/list-api/internal/middleware"
+	"github.com/mikemcavoydev/list-api/internal/tokens"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RequestLogger(app.Logger))
+	r.Use(middleware.CORS(app.Config.CORSOrigins))
 
 	r.Group(func(r chi.Router) {
 		r.Use(app.Middleware.Authenticate)
 
-		r.Get("/lists/{id}", app.Middleware.RequireUser(app.ListHandler.HandleGetListById))
-		r.Post("/lists", app.Middleware.RequireUser(app.ListHandler.HandleCreateListById))
-		r.Put("/lists/{id}", app.Middleware.RequireUser(app.ListHandler.HandleUpdateListById))
-		r.Delete("/lists/{id}", app.Middleware.RequireUser(app.ListHandler.HandleDeleteList))
+		r.Get("/public/lists/{slug}", app.ListHandler.HandleGetPublicList)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.Middleware.RequireScope(tokens.PermissionListsRead))
+
+			r.Get("/lists", app.Middleware.RequireUser(app.ListHandler.HandleGetLists))
+			r.Get("/lists/trash", app.Middleware.RequireUser(app.ListHandler.HandleGetTrash))
+			r.Get("/lists/{id}", app.Middleware.RequireUser(app.ListHandler.HandleGetListById))
+			r.Get("/lists/{id}/entries/{entryID}", app.Middleware.RequireUser(app.ListEntryHandler.HandleGetListEntry))
+			r.Get("/lists/{id}/members", app.Middleware.RequireUser(app.ListMemberHandler.HandleGetListMembers))
+			r.Get("/lists/{id}/revisions", app.Middleware.RequireUser(app.ListRevisionHandler.HandleGetListRevisions))
+			r.Get("/lists/{id}/revisions/{rev}", app.Middleware.RequireUser(app.ListRevisionHandler.HandleGetListRevision))
+			r.Get("/lists/{id}/revisions/{rev}/diff", app.Middleware.RequireUser(app.ListRevisionHandler.HandleDiffListRevisions))
+
+			r.With(app.Middleware.LoadUser).Get("/users/me", app.Middleware.RequireUser(app.UserHandler.HandleGetCurrentUser))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.Middleware.RequireScope(tokens.PermissionListsWrite))
+			// Writes need the stored user, so a JWT of a deleted or deactivated
+			// user does not pass on its stale claims.
+			r.Use(app.Middleware.LoadUser)
+
+			r.Post("/lists/{id}/restore", app.Middleware.RequireActivatedUser(app.ListHandler.HandleRestoreList))
+			r.Post("/lists", app.Middleware.RequireActivatedUser(app.ListHandler.HandleCreateListById))
+			r.Put("/lists/{id}", app.Middleware.RequireActivatedUser(app.ListHandler.HandleUpdateListById))
+			r.Patch("/lists/{id}", app.Middleware.RequireActivatedUser(app.ListHandler.HandlePatchListById))
+			r.Delete("/lists/{id}", app.Middleware.RequireActivatedUser(app.ListHandler.HandleDeleteList))
+
+			r.Post("/lists/{id}/entries", app.Middleware.RequireActivatedUser(app.ListEntryHandler.HandleCreateListEntry))
+			r.Post("/lists/{id}/entries/reorder", app.Middleware.RequireActivatedUser(app.ListEntryHandler.HandleReorderListEntries))
+			r.Patch("/lists/{id}/entries/{entryID}", app.Middleware.RequireActivatedUser(app.ListEntryHandler.HandleUpdateListEntry))
+			r.Delete("/lists/{id}/entries/{entryID}", app.Middleware.RequireActivatedUser(app.ListEntryHandler.HandleDeleteListEntry))
+
+			r.Post("/lists/{id}/members", app.Middleware.RequireActivatedUser(app.ListMemberHandler.HandleAddListMember))
+			r.Patch("/lists/{id}/members/{username}", app.Middleware.RequireActivatedUser(app.ListMemberHandler.HandleUpdateListMember))
+			r.Delete("/lists/{id}/members/{username}", app.Middleware.RequireActivatedUser(app.ListMemberHandler.HandleRemoveListMember))
+
+			r.Post("/lists/{id}/revisions/{rev}/restore", app.Middleware.RequireActivatedUser(app.ListRevisionHandler.HandleRestoreListRevision))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.Middleware.RequireScope(tokens.PermissionAccountManage))
+			r.Use(app.Middleware.LoadUser)
+
+			r.Get("/tokens", app.Middleware.RequireUser(app.TokenHandler.HandleGetTokens))
+			r.Delete("/tokens", app.Middleware.RequireUser(app.TokenHandler.HandleDeleteAllTokens))
+			r.Delete("/tokens/current", app.Middleware.RequireUser(app.TokenHandler.HandleDeleteCurrentToken))
+			r.Delete("/tokens/{id}", app.Middleware.RequireUser(app.TokenHandler.HandleDeleteToken))
+
+			r.Get("/users/me/tokens", app.Middleware.RequireUser(app.TokenHandler.HandleGetPersonalTokens))
+			r.Post("/users/me/tokens", app.Middleware.RequireUser(app.TokenHandler.HandleCreatePersonalToken))
+			r.Delete("/users/me/tokens/{id}", app.Middleware.RequireUser(app.TokenHandler.HandleDeletePersonalToken))
+
+			r.Post("/users/me/activation", app.Middleware.RequireUser(app.UserHandler.HandleResendActivation))
+			r.Patch("/users/me", app.Middleware.RequireUser(app.UserHandler.HandleUpdateCurrentUser))
+			r.Put("/users/me/password", app.Middleware.RequireUser(app.UserHandler.HandleChangePassword))
+			r.Delete("/users/me", app.Middleware.RequireUser(app.UserHandler.HandleDeleteCurrentUser))
+
+			r.Post("/users/me/mfa/totp", app.Middleware.RequireUser(app.MFAHandler.HandleEnrollTOTP))
+			r.Post("/users/me/mfa/totp/confirm", app.Middleware.RequireUser(app.MFAHandler.HandleConfirmTOTP))
+			r.Delete("/users/me/mfa/totp", app.Middleware.RequireUser(app.MFAHandler.HandleDisableTOTP))
+
+			r.Get("/admin/lockouts", app.Middleware.RequireAdmin(app.AdminHandler.HandleGetLockouts))
+			r.Delete("/admin/lockouts", app.Middleware.RequireAdmin(app.AdminHandler.HandleUnlock))
+		})
 	})
 
 	r.Get("/health", app.HealthCheck)
+	r.Get("/.well-known/jwks.json", app.TokenHandler.HandleGetJWKS)
 
 	r.Post("/users", app.UserHandler.HandleRegisterUser)
+	r.Put("/users/password", app.UserHandler.HandleResetPassword)
+	r.Put("/users/activated", app.UserHandler.HandleActivateUser)
 
 	r.Post("/tokens/authenticate", app.TokenHandler.HandleCreateToken)
+	r.Post("/tokens/mfa", app.TokenHandler.HandleVerifyMFA)
+	r.Post("/tokens/refresh", app.TokenHandler.HandleRefreshToken)
+	r.Post("/tokens/password-reset", app.TokenHandler.HandleCreatePasswordResetToken)
 
 	return r
 }
@@ -1,21 +1,37 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/fs"
+	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/mikemcavoydev/list-api/internal/config"
 	"github.com/pressly/goose/v3"
 )
 
-func Open() (*sql.DB, error) {
-	db, err := sql.Open("pgx", "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable")
+// Open returns a connection pool for the database cfg describes, after
+// checking that the database can be reached.
+func Open(cfg config.DB) (*sql.DB, error) {
+	db, err := sql.Open("pgx", cfg.DSN)
 	if err != nil {
 		return nil, fmt.Errorf("db: open %w", err)
 	}
 
-	fmt.Println("Connected to database...")
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxIdleTime(cfg.MaxIdleTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db: ping %w", err)
+	}
 
 	return db, nil
 }
@@ -43,3 +59,16 @@ func Migrate(db *sql.DB, dir string) error {
 
 	return nil
 }
+
+// queryTimeout bounds how long a store method may spend in the database,
+// including every query of a transaction. Zero only limits it by the
+// caller's context. The Postgres stores embed it.
+type queryTimeout time.Duration
+
+func (t queryTimeout) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(t))
+}
@@ -0,0 +1,464 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Entries of a list always use order_index values 0..n-1 with no duplicates or
+// gaps. The database enforces this with a deferred unique constraint and a
+// deferred constraint trigger, so every write below rewrites the full order of
+// the list inside the same transaction.
+
+var ErrInvalidEntryOrder = errors.New("entry ids must contain every entry of the list exactly once")
+
+type entryQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// normaliseEntryOrder sorts entries by their requested order index, keeping
+// the given order for ties, and renumbers them from zero.
+func normaliseEntryOrder(entries []ListEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].OrderIndex < entries[j].OrderIndex
+	})
+
+	for i := range entries {
+		entries[i].OrderIndex = i
+	}
+}
+
+const entryColumns = `id, title, order_index, completed, completed_at, due_at, priority, notes`
+
+func entryScanTargets(entry *ListEntry) []interface{} {
+	return []interface{}{
+		&entry.ID,
+		&entry.Title,
+		&entry.OrderIndex,
+		&entry.Completed,
+		&entry.CompletedAt,
+		&entry.DueAt,
+		&entry.Priority,
+		&entry.Notes,
+	}
+}
+
+func insertEntry(ctx context.Context, tx *sql.Tx, listID int64, entry *ListEntry) error {
+	query := `
+		INSERT INTO list_entries (list_id, title, order_index, completed, completed_at, due_at, priority, notes)
+		VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN CURRENT_TIMESTAMP END, $5, $6, $7)
+		RETURNING id, completed_at`
+
+	return tx.QueryRowContext(
+		ctx, query, listID, entry.Title, entry.OrderIndex, entry.Completed, entry.DueAt, entry.Priority, entry.Notes,
+	).Scan(&entry.ID, &entry.CompletedAt)
+}
+
+// updateEntry saves every field of an existing entry except its position.
+func updateEntry(ctx context.Context, tx *sql.Tx, listID int64, entry *ListEntry) error {
+	query := `
+		UPDATE list_entries SET
+			title = $1,
+			completed = $2,
+			completed_at = CASE
+				WHEN NOT $2 THEN NULL
+				WHEN completed THEN completed_at
+				ELSE CURRENT_TIMESTAMP
+			END,
+			due_at = $3,
+			priority = $4,
+			notes = $5,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $6 AND list_id = $7
+		RETURNING completed_at`
+
+	return tx.QueryRowContext(
+		ctx, query, entry.Title, entry.Completed, entry.DueAt, entry.Priority, entry.Notes, entry.ID, listID,
+	).Scan(&entry.CompletedAt)
+}
+
+func queryEntries(ctx context.Context, q entryQuerier, listID int64, filter EntryFilter) ([]ListEntry, error) {
+	query :=
+		`SELECT ` + entryColumns + ` FROM list_entries WHERE list_id = $1`
+	args := []interface{}{listID}
+
+	if filter.Completed != nil {
+		args = append(args, *filter.Completed)
+		query += fmt.Sprintf(" AND completed = $%d", len(args))
+	}
+
+	column, ok := entrySortColumns[filter.Sort]
+	if !ok {
+		column = "order_index"
+	}
+
+	direction := "ASC"
+	if filter.Descending {
+		direction = "DESC"
+	}
+
+	// Entries without a due date always sort after those with one.
+	query += fmt.Sprintf(" ORDER BY %s %s NULLS LAST, order_index", column, direction)
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ListEntry{}
+	for rows.Next() {
+		var entry ListEntry
+		err = rows.Scan(entryScanTargets(&entry)...)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// touchList bumps the version and updated_at of a list after one of its
+// entries changed, so ETags of the list change with its entries, and records
+// the change as a revision authored by authorID.
+func touchList(ctx context.Context, tx *sql.Tx, listID int64, authorID int) error {
+	list := &List{}
+
+	query := `
+		UPDATE lists SET version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING id, title, description`
+
+	err := tx.QueryRowContext(ctx, query, listID).Scan(&list.ID, &list.Title, &list.Description)
+	if err != nil {
+		return err
+	}
+
+	list.Entries, err = queryEntries(ctx, tx, listID, EntryFilter{})
+	if err != nil {
+		return err
+	}
+
+	return recordRevision(ctx, tx, list, authorID)
+}
+
+// lockEntryOrder locks the list row so concurrent reorders of the same list
+// are serialised, and returns the current entry ids in order.
+func lockEntryOrder(ctx context.Context, tx *sql.Tx, listID int64) ([]int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM lists WHERE id = $1 FOR UPDATE`, listID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM list_entries WHERE list_id = $1 ORDER BY order_index, id`, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var entryID int64
+		err = rows.Scan(&entryID)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, entryID)
+	}
+
+	return ids, rows.Err()
+}
+
+func applyEntryOrder(ctx context.Context, tx *sql.Tx, listID int64, ids []int64) error {
+	query := `
+		UPDATE list_entries e SET order_index = o.ord - 1
+		FROM unnest($1::bigint[]) WITH ORDINALITY AS o(id, ord)
+		WHERE e.id = o.id AND e.list_id = $2 AND e.order_index <> o.ord - 1`
+
+	_, err := tx.ExecContext(ctx, query, ids, listID)
+	return err
+}
+
+func indexOfEntry(ids []int64, entryID int64) int {
+	for i, id := range ids {
+		if id == entryID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// moveEntry returns ids with the entry at from moved to position to.
+func moveEntry(ids []int64, from, to int) []int64 {
+	entryID := ids[from]
+	moved := make([]int64, 0, len(ids))
+	moved = append(moved, ids[:from]...)
+	moved = append(moved, ids[from+1:]...)
+	moved = append(moved[:to], append([]int64{entryID}, moved[to:]...)...)
+
+	return moved
+}
+
+// CreateListEntry inserts entry at entry.OrderIndex, shifting the entries at
+// and after that position down by one. An index outside the list appends the
+// entry instead.
+func (s *PostgresListStore) CreateListEntry(ctx context.Context, listID int64, entry *ListEntry, authorID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockEntryOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	position := entry.OrderIndex
+	if position < 0 || position > len(ids) {
+		position = len(ids)
+	}
+
+	entry.OrderIndex = len(ids)
+	err = insertEntry(ctx, tx, listID, entry)
+	if err != nil {
+		return err
+	}
+
+	if position != len(ids) {
+		ids = moveEntry(append(ids, int64(entry.ID)), len(ids), position)
+		err = applyEntryOrder(ctx, tx, listID, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry.OrderIndex = position
+
+	err = touchList(ctx, tx, listID, authorID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresListStore) GetListEntry(ctx context.Context, listID, entryID int64) (*ListEntry, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	entry := &ListEntry{}
+
+	query :=
+		`SELECT ` + entryColumns + ` FROM list_entries WHERE id = $1 AND list_id = $2`
+
+	err := s.db.QueryRowContext(ctx, query, entryID, listID).Scan(entryScanTargets(entry)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// UpdateListEntry saves the entry's fields and, when its order index has
+// changed, moves it to that position. The index is clamped to the list.
+// completed_at is stamped when the entry becomes completed and cleared when it
+// is reopened.
+func (s *PostgresListStore) UpdateListEntry(ctx context.Context, listID int64, entry *ListEntry, authorID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockEntryOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	current := indexOfEntry(ids, int64(entry.ID))
+	if current == -1 {
+		return sql.ErrNoRows
+	}
+
+	err = updateEntry(ctx, tx, listID, entry)
+	if err != nil {
+		return err
+	}
+
+	position := entry.OrderIndex
+	if position < 0 {
+		position = 0
+	}
+	if position > len(ids)-1 {
+		position = len(ids) - 1
+	}
+
+	if position != current {
+		err = applyEntryOrder(ctx, tx, listID, moveEntry(ids, current, position))
+		if err != nil {
+			return err
+		}
+	}
+
+	entry.OrderIndex = position
+
+	err = touchList(ctx, tx, listID, authorID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresListStore) DeleteListEntry(ctx context.Context, listID, entryID int64, authorID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockEntryOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	current := indexOfEntry(ids, entryID)
+	if current == -1 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM list_entries WHERE id = $1 AND list_id = $2`, entryID, listID)
+	if err != nil {
+		return err
+	}
+
+	remaining := append(ids[:current:current], ids[current+1:]...)
+	err = applyEntryOrder(ctx, tx, listID, remaining)
+	if err != nil {
+		return err
+	}
+
+	err = touchList(ctx, tx, listID, authorID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReorderListEntries sets the order of a list's entries to the order of
+// entryIDs, which must name every entry of the list exactly once.
+func (s *PostgresListStore) ReorderListEntries(ctx context.Context, listID int64, entryIDs []int64, authorID int) ([]ListEntry, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockEntryOrder(ctx, tx, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entryIDs) != len(ids) {
+		return nil, ErrInvalidEntryOrder
+	}
+
+	seen := make(map[int64]bool, len(entryIDs))
+	for _, id := range entryIDs {
+		if seen[id] || indexOfEntry(ids, id) == -1 {
+			return nil, ErrInvalidEntryOrder
+		}
+		seen[id] = true
+	}
+
+	err = applyEntryOrder(ctx, tx, listID, entryIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = touchList(ctx, tx, listID, authorID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := queryEntries(ctx, tx, listID, EntryFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, tx.Commit()
+}
+
+// MoveListEntry moves one entry directly before, or after, the anchor entry.
+func (s *PostgresListStore) MoveListEntry(ctx context.Context, listID, entryID, anchorID int64, after bool, authorID int) ([]ListEntry, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockEntryOrder(ctx, tx, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entryID == anchorID {
+		return nil, ErrInvalidEntryOrder
+	}
+
+	current := indexOfEntry(ids, entryID)
+	if current == -1 || indexOfEntry(ids, anchorID) == -1 {
+		return nil, sql.ErrNoRows
+	}
+
+	without := append(ids[:current:current], ids[current+1:]...)
+	position := indexOfEntry(without, anchorID)
+	if after {
+		position++
+	}
+
+	err = applyEntryOrder(ctx, tx, listID, moveEntry(ids, current, position))
+	if err != nil {
+		return nil, err
+	}
+
+	err = touchList(ctx, tx, listID, authorID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := queryEntries(ctx, tx, listID, EntryFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, tx.Commit()
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+
+	// RolePublic is what non-members get on a public list. It only allows
+	// reading the list and its entries, not its members or history, and
+	// cannot be given to a member.
+	RolePublic = "public"
+)
+
+var roleRank = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// ValidRole reports whether role is one of the list member roles.
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleAllows reports whether a member with role may do something that
+// requires at least the required role. An empty role allows nothing, and
+// RolePublic only allows what requires RolePublic.
+func RoleAllows(role, required string) bool {
+	return role != "" && roleRank[role] >= roleRank[required]
+}
+
+var (
+	ErrAlreadyMember = errors.New("user is already a member of this list")
+	ErrLastOwner     = errors.New("a list must keep at least one owner")
+)
+
+type ListMember struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetListRole returns the role userID holds on the list. Non-members get
+// RolePublic on public lists and an empty string otherwise. It returns
+// sql.ErrNoRows if the list does not exist or is in the trash.
+func (s *PostgresListStore) GetListRole(ctx context.Context, listID int64, userID int) (string, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var role string
+
+	query := `
+		SELECT COALESCE(m.role, CASE WHEN l.visibility = 'public' THEN 'public' ELSE '' END)
+		FROM lists l
+		LEFT JOIN list_members m ON m.list_id = l.id AND m.user_id = $2
+		WHERE l.id = $1 AND l.deleted_at IS NULL`
+
+	err := s.db.QueryRowContext(ctx, query, listID, userID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+func (s *PostgresListStore) GetListMembers(ctx context.Context, listID int64) ([]ListMember, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT u.id, u.username, m.role, m.created_at
+		FROM list_members m
+		INNER JOIN users u ON u.id = m.user_id
+		WHERE m.list_id = $1
+		ORDER BY m.created_at, u.id`
+
+	rows, err := s.db.QueryContext(ctx, query, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ListMember{}
+	for rows.Next() {
+		var member ListMember
+		err = rows.Scan(&member.UserID, &member.Username, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *PostgresListStore) AddListMember(ctx context.Context, listID int64, userID int, role string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (list_id, user_id) DO NOTHING`
+
+	result, err := s.db.ExecContext(ctx, query, listID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrAlreadyMember
+	}
+
+	return nil
+}
+
+// lockOwners locks the list's membership rows and returns how many owners the
+// list has, so demoting or removing an owner cannot race another change.
+func lockOwners(ctx context.Context, tx *sql.Tx, listID int64) (int, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT role FROM list_members WHERE list_id = $1 FOR UPDATE`, listID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	owners := 0
+	for rows.Next() {
+		var role string
+		err = rows.Scan(&role)
+		if err != nil {
+			return 0, err
+		}
+
+		if role == RoleOwner {
+			owners++
+		}
+	}
+
+	return owners, rows.Err()
+}
+
+func (s *PostgresListStore) UpdateListMemberRole(ctx context.Context, listID int64, userID int, role string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owners, err := lockOwners(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	var current string
+	err = tx.QueryRowContext(ctx, `SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2`, listID, userID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if current == RoleOwner && role != RoleOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE list_members SET role = $1 WHERE list_id = $2 AND user_id = $3`, role, listID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresListStore) RemoveListMember(ctx context.Context, listID int64, userID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owners, err := lockOwners(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	var current string
+	err = tx.QueryRowContext(ctx, `SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2`, listID, userID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if current == RoleOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM list_members WHERE list_id = $1 AND user_id = $2`, listID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// ListRevision is an immutable snapshot of a list taken every time it is
+// created or updated. Revisions are numbered from 1 per list.
+type ListRevision struct {
+	ListID      int         `json:"list_id"`
+	Revision    int         `json:"revision"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Entries     []ListEntry `json:"entries,omitempty"`
+	AuthorID    *int        `json:"author_id"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type EntryChange struct {
+	ID   int       `json:"id"`
+	From ListEntry `json:"from"`
+	To   ListEntry `json:"to"`
+}
+
+// ListDiff describes how a list changed between two revisions. Entries are
+// matched by ID.
+type ListDiff struct {
+	From           int           `json:"from"`
+	To             int           `json:"to"`
+	Title          *FieldChange  `json:"title,omitempty"`
+	Description    *FieldChange  `json:"description,omitempty"`
+	EntriesAdded   []ListEntry   `json:"entries_added"`
+	EntriesRemoved []ListEntry   `json:"entries_removed"`
+	EntriesChanged []EntryChange `json:"entries_changed"`
+}
+
+func DiffRevisions(from, to *ListRevision) ListDiff {
+	diff := ListDiff{
+		From:           from.Revision,
+		To:             to.Revision,
+		EntriesAdded:   []ListEntry{},
+		EntriesRemoved: []ListEntry{},
+		EntriesChanged: []EntryChange{},
+	}
+
+	if from.Title != to.Title {
+		diff.Title = &FieldChange{From: from.Title, To: to.Title}
+	}
+
+	if from.Description != to.Description {
+		diff.Description = &FieldChange{From: from.Description, To: to.Description}
+	}
+
+	before := make(map[int]ListEntry, len(from.Entries))
+	for _, entry := range from.Entries {
+		before[entry.ID] = entry
+	}
+
+	after := make(map[int]bool, len(to.Entries))
+	for _, entry := range to.Entries {
+		after[entry.ID] = true
+
+		old, ok := before[entry.ID]
+		if !ok {
+			diff.EntriesAdded = append(diff.EntriesAdded, entry)
+			continue
+		}
+
+		if !entriesEqual(old, entry) {
+			diff.EntriesChanged = append(diff.EntriesChanged, EntryChange{ID: entry.ID, From: old, To: entry})
+		}
+	}
+
+	for _, entry := range from.Entries {
+		if !after[entry.ID] {
+			diff.EntriesRemoved = append(diff.EntriesRemoved, entry)
+		}
+	}
+
+	return diff
+}
+
+func entriesEqual(a, b ListEntry) bool {
+	return a.Title == b.Title &&
+		a.OrderIndex == b.OrderIndex &&
+		a.Completed == b.Completed &&
+		timesEqual(a.DueAt, b.DueAt) &&
+		a.Priority == b.Priority &&
+		a.Notes == b.Notes
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// recordRevision snapshots list, including its entries, as the next revision.
+// It must run in the transaction that changed the list so the list row lock
+// keeps revision numbers unique.
+func recordRevision(ctx context.Context, tx *sql.Tx, list *List, authorID int) error {
+	entries := list.Entries
+	if entries == nil {
+		entries = []ListEntry{}
+	}
+
+	js, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	var author *int
+	if authorID != 0 {
+		author = &authorID
+	}
+
+	query := `
+		INSERT INTO list_revisions (list_id, revision, title, description, entries, author_id)
+		SELECT $1, COALESCE(MAX(revision), 0) + 1, $2, $3, $4, $5
+		FROM list_revisions WHERE list_id = $1`
+
+	_, err = tx.ExecContext(ctx, query, list.ID, list.Title, list.Description, string(js), author)
+	return err
+}
+
+// GetListRevisions returns every revision of a list, newest first, without
+// their entries.
+func (s *PostgresListStore) GetListRevisions(ctx context.Context, listID int64) ([]ListRevision, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT list_id, revision, title, description, author_id, created_at
+		FROM list_revisions
+		WHERE list_id = $1
+		ORDER BY revision DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ListRevision{}
+	for rows.Next() {
+		var revision ListRevision
+		err = rows.Scan(
+			&revision.ListID,
+			&revision.Revision,
+			&revision.Title,
+			&revision.Description,
+			&revision.AuthorID,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *PostgresListStore) GetListRevision(ctx context.Context, listID int64, revision int) (*ListRevision, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	rev := &ListRevision{}
+	var entries []byte
+
+	query := `
+		SELECT list_id, revision, title, description, entries, author_id, created_at
+		FROM list_revisions
+		WHERE list_id = $1 AND revision = $2`
+
+	err := s.db.QueryRowContext(ctx, query, listID, revision).Scan(
+		&rev.ListID,
+		&rev.Revision,
+		&rev.Title,
+		&rev.Description,
+		&entries,
+		&rev.AuthorID,
+		&rev.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(entries, &rev.Entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return rev, nil
+}
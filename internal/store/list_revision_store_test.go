@@ -0,0 +1,69 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffRevisions(t *testing.T) {
+	due := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	from := &ListRevision{
+		Revision:    1,
+		Title:       "Groceries",
+		Description: "Weekly shop",
+		Entries: []ListEntry{
+			{ID: 1, Title: "Milk", OrderIndex: 0},
+			{ID: 2, Title: "Eggs", OrderIndex: 1},
+			{ID: 3, Title: "Bread", OrderIndex: 2, DueAt: &due},
+		},
+	}
+
+	sameDue := due.In(time.FixedZone("offset", 3600))
+	to := &ListRevision{
+		Revision:    2,
+		Title:       "Groceries",
+		Description: "Weekend shop",
+		Entries: []ListEntry{
+			{ID: 2, Title: "Eggs", OrderIndex: 0, Completed: true},
+			{ID: 3, Title: "Bread", OrderIndex: 1, DueAt: &sameDue},
+			{ID: 4, Title: "Butter", OrderIndex: 2},
+		},
+	}
+
+	diff := DiffRevisions(from, to)
+
+	assert.Equal(t, 1, diff.From)
+	assert.Equal(t, 2, diff.To)
+	assert.Nil(t, diff.Title)
+	assert.Equal(t, &FieldChange{From: "Weekly shop", To: "Weekend shop"}, diff.Description)
+
+	assert.Len(t, diff.EntriesAdded, 1)
+	assert.Equal(t, 4, diff.EntriesAdded[0].ID)
+
+	assert.Len(t, diff.EntriesRemoved, 1)
+	assert.Equal(t, 1, diff.EntriesRemoved[0].ID)
+
+	assert.Len(t, diff.EntriesChanged, 2)
+	assert.Equal(t, 2, diff.EntriesChanged[0].ID)
+	assert.True(t, diff.EntriesChanged[0].To.Completed)
+	assert.Equal(t, 3, diff.EntriesChanged[1].ID)
+	assert.Equal(t, 1, diff.EntriesChanged[1].To.OrderIndex)
+}
+
+func TestDiffRevisionsAgainstEmpty(t *testing.T) {
+	to := &ListRevision{
+		Revision: 1,
+		Title:    "New",
+		Entries:  []ListEntry{{ID: 1, Title: "First"}},
+	}
+
+	diff := DiffRevisions(&ListRevision{}, to)
+
+	assert.Equal(t, &FieldChange{From: "", To: "New"}, diff.Title)
+	assert.Len(t, diff.EntriesAdded, 1)
+	assert.Empty(t, diff.EntriesRemoved)
+	assert.Empty(t, diff.EntriesChanged)
+}
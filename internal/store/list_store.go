@@ -1,7 +1,14 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
 type List struct {
@@ -10,54 +17,239 @@ type List struct {
 	Description string      `json:"description"`
 	Entries     []ListEntry `json:"entries"`
 	UserID      int         `json:"user_id"`
+	Visibility  string      `json:"visibility"`
+	Slug        string      `json:"slug"`
+	Version     int         `json:"version"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	DeletedAt   *time.Time  `json:"deleted_at,omitempty"`
+}
+
+// Private lists are only visible to their members. Unlisted lists can also be
+// read by anyone holding their slug, and public lists by anyone at all.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+// ValidVisibility reports whether visibility is one of the list visibilities.
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+const listColumns = `id, title, description, user_id, visibility, slug, version, created_at, updated_at, deleted_at`
+
+func listScanTargets(list *List) []interface{} {
+	return []interface{}{
+		&list.ID,
+		&list.Title,
+		&list.Description,
+		&list.UserID,
+		&list.Visibility,
+		&list.Slug,
+		&list.Version,
+		&list.CreatedAt,
+		&list.UpdatedAt,
+		&list.DeletedAt,
+	}
 }
 
 type ListEntry struct {
-	ID         int    `json:"id"`
-	Title      string `json:"title"`
-	OrderIndex int    `json:"order_index"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	OrderIndex  int        `json:"order_index"`
+	Completed   bool       `json:"completed"`
+	CompletedAt *time.Time `json:"completed_at"`
+	DueAt       *time.Time `json:"due_at"`
+	Priority    int        `json:"priority"`
+	Notes       string     `json:"notes"`
+}
+
+const (
+	PriorityNone = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
+
+// EntryFilter narrows and orders the entries returned with a list. The zero
+// value returns every entry in list order.
+type EntryFilter struct {
+	Completed  *bool
+	Sort       string
+	Descending bool
+}
+
+var entrySortColumns = map[string]string{
+	"order_index": "order_index",
+	"due_at":      "due_at",
+	"priority":    "priority",
+}
+
+// ValidEntrySort reports whether sort is a column entries can be ordered by.
+func ValidEntrySort(sort string) bool {
+	_, ok := entrySortColumns[sort]
+	return ok
+}
+
+// ListFilter controls which of a user's lists are returned by GetListsForUser
+// and in what order. Cursor is the opaque value returned as the next cursor of
+// a previous page.
+type ListFilter struct {
+	Title          string
+	Sort           string
+	Descending     bool
+	Cursor         string
+	Limit          int
+	IncludeEntries bool
+}
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrEditConflict  = errors.New("list has been modified since it was read")
+)
+
+var listSortColumns = map[string]string{
+	"title":      "title",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// ValidListSort reports whether sort is a column lists can be ordered by.
+func ValidListSort(sort string) bool {
+	_, ok := listSortColumns[sort]
+	return ok
+}
+
+type listCursor struct {
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func encodeListCursor(sort string, list *List) (string, error) {
+	cursor := listCursor{ID: list.ID}
+	switch sort {
+	case "title":
+		cursor.Value = list.Title
+	case "created_at":
+		cursor.Value = list.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		cursor.Value = list.UpdatedAt.Format(time.RFC3339Nano)
+	}
+
+	js, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+func decodeListCursor(sort, encoded string) (interface{}, int, error) {
+	js, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	var cursor listCursor
+	err = json.Unmarshal(js, &cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	if sort == "title" {
+		return cursor.Value, cursor.ID, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, cursor.Value)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	return t, cursor.ID, nil
 }
 
 type ListStore interface {
-	CreateList(list *List) (*List, error)
-	GetListByID(id int64) (*List, error)
-	UpdateList(list *List) error
-	DeleteList(id int64) error
-	GetListOwner(id int64) (int, error)
+	CreateList(ctx context.Context, list *List) (*List, error)
+	GetListByID(ctx context.Context, id int64) (*List, error)
+	GetFilteredListByID(ctx context.Context, id int64, filter EntryFilter) (*List, error)
+	GetListBySlug(ctx context.Context, slug string) (*List, error)
+	GetListsForUser(ctx context.Context, userID int, filter ListFilter) ([]*List, string, error)
+	UpdateList(ctx context.Context, list *List, authorID int) error
+	DeleteList(ctx context.Context, id int64, version int) error
+	GetTrashedLists(ctx context.Context, userID int) ([]*List, error)
+	RestoreList(ctx context.Context, id int64, userID int) error
+	PurgeDeletedLists(ctx context.Context, cutoff time.Time) (int64, error)
+	GetListRevisions(ctx context.Context, listID int64) ([]ListRevision, error)
+	GetListRevision(ctx context.Context, listID int64, revision int) (*ListRevision, error)
+	GetListOwner(ctx context.Context, id int64) (int, error)
+	CreateListEntry(ctx context.Context, listID int64, entry *ListEntry, authorID int) error
+	GetListEntry(ctx context.Context, listID, entryID int64) (*ListEntry, error)
+	UpdateListEntry(ctx context.Context, listID int64, entry *ListEntry, authorID int) error
+	DeleteListEntry(ctx context.Context, listID, entryID int64, authorID int) error
+	ReorderListEntries(ctx context.Context, listID int64, entryIDs []int64, authorID int) ([]ListEntry, error)
+	MoveListEntry(ctx context.Context, listID, entryID, anchorID int64, after bool, authorID int) ([]ListEntry, error)
+	GetListRole(ctx context.Context, listID int64, userID int) (string, error)
+	GetListMembers(ctx context.Context, listID int64) ([]ListMember, error)
+	AddListMember(ctx context.Context, listID int64, userID int, role string) error
+	UpdateListMemberRole(ctx context.Context, listID int64, userID int, role string) error
+	RemoveListMember(ctx context.Context, listID int64, userID int) error
 }
 
 type PostgresListStore struct {
 	db *sql.DB
+	queryTimeout
 }
 
-func NewPostgresListStore(db *sql.DB) *PostgresListStore {
-	return &PostgresListStore{db: db}
+func NewPostgresListStore(db *sql.DB, timeout time.Duration) *PostgresListStore {
+	return &PostgresListStore{db: db, queryTimeout: queryTimeout(timeout)}
 }
 
-func (s *PostgresListStore) CreateList(list *List) (*List, error) {
-	tx, err := s.db.Begin()
+func (s *PostgresListStore) CreateList(ctx context.Context, list *List) (*List, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
 	query :=
-		`INSERT INTO lists (user_id, title, description) VALUES ($1, $2, $3) RETURNING id`
+		`INSERT INTO lists (user_id, title, description, visibility) VALUES ($1, $2, $3, $4) RETURNING id, slug, version, created_at, updated_at`
+
+	if list.Visibility == "" {
+		list.Visibility = VisibilityPrivate
+	}
+
+	err = tx.QueryRowContext(ctx, query, list.UserID, list.Title, list.Description, list.Visibility).Scan(&list.ID, &list.Slug, &list.Version, &list.CreatedAt, &list.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
 
-	err = tx.QueryRow(query, list.UserID, list.Title, list.Description).Scan(&list.ID)
+	_, err = tx.ExecContext(ctx, `INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)`, list.ID, list.UserID, RoleOwner)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, entry := range list.Entries {
-		query :=
-			`INSERT INTO list_entries (list_id, title, order_index) VALUES ($1, $2, $3) RETURNING id`
-		err = tx.QueryRow(query, list.ID, entry.Title, entry.OrderIndex).Scan(&entry.ID)
+	normaliseEntryOrder(list.Entries)
+	for i := range list.Entries {
+		err = insertEntry(ctx, tx, int64(list.ID), &list.Entries[i])
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	err = recordRevision(ctx, tx, list, list.UserID)
+	if err != nil {
+		return nil, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return nil, err
@@ -66,13 +258,23 @@ func (s *PostgresListStore) CreateList(list *List) (*List, error) {
 	return list, nil
 }
 
-func (s *PostgresListStore) GetListByID(id int64) (*List, error) {
+func (s *PostgresListStore) GetListByID(ctx context.Context, id int64) (*List, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	return s.GetFilteredListByID(ctx, id, EntryFilter{})
+}
+
+func (s *PostgresListStore) GetFilteredListByID(ctx context.Context, id int64, filter EntryFilter) (*List, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	list := &List{}
 
 	query :=
-		`SELECT id, title, description, user_id FROM lists WHERE id = $1`
+		`SELECT ` + listColumns + ` FROM lists WHERE id = $1 AND deleted_at IS NULL`
 
-	err := s.db.QueryRow(query, id).Scan(&list.ID, &list.Title, &list.Description, &list.UserID)
+	err := s.db.QueryRowContext(ctx, query, id).Scan(listScanTargets(list)...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -80,43 +282,249 @@ func (s *PostgresListStore) GetListByID(id int64) (*List, error) {
 		return nil, err
 	}
 
-	entryQuery :=
-		`SELECT id, title, order_index FROM list_entries WHERE list_id = $1 ORDER BY order_index`
+	list.Entries, err = queryEntries(ctx, s.db, id, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// GetListBySlug returns the list with the given slug, or nil if there is none.
+// Callers are responsible for checking the list's visibility.
+func (s *PostgresListStore) GetListBySlug(ctx context.Context, slug string) (*List, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	list := &List{}
+
+	query :=
+		`SELECT ` + listColumns + ` FROM lists WHERE slug = $1 AND deleted_at IS NULL`
+
+	err := s.db.QueryRowContext(ctx, query, slug).Scan(listScanTargets(list)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := s.db.Query(entryQuery, id)
+	list.Entries, err = queryEntries(ctx, s.db, int64(list.ID), EntryFilter{})
 	if err != nil {
 		return nil, err
 	}
+
+	return list, nil
+}
+
+// GetListsForUser returns a page of the lists the user is a member of,
+// including lists others have shared with them.
+func (s *PostgresListStore) GetListsForUser(ctx context.Context, userID int, filter ListFilter) ([]*List, string, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	column, ok := listSortColumns[filter.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid sort column %q", filter.Sort)
+	}
+
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	query := `
+		SELECT ` + listColumns + `
+		FROM lists
+		WHERE deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM list_members m WHERE m.list_id = lists.id AND m.user_id = $1
+		)`
+	args := []interface{}{userID}
+
+	if filter.Title != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Title)
+		args = append(args, "%"+escaped+"%")
+		query += fmt.Sprintf(" AND title ILIKE $%d", len(args))
+	}
+
+	if filter.Cursor != "" {
+		value, id, err := decodeListCursor(filter.Sort, filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		args = append(args, value, id)
+		query += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, comparison, len(args)-1, len(args))
+	}
+
+	// Fetch one extra row so we know whether another page follows.
+	args = append(args, filter.Limit+1)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	lists := []*List{}
+	for rows.Next() {
+		list := &List{}
+		err = rows.Scan(listScanTargets(list)...)
+		if err != nil {
+			return nil, "", err
+		}
+
+		lists = append(lists, list)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var nextCursor string
+	if len(lists) > filter.Limit {
+		lists = lists[:filter.Limit]
+		nextCursor, err = encodeListCursor(filter.Sort, lists[len(lists)-1])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if filter.IncludeEntries && len(lists) > 0 {
+		err = s.loadEntries(ctx, lists)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return lists, nextCursor, nil
+}
+
+// loadEntries fetches the entries for every list in a single query rather
+// than issuing one query per list.
+func (s *PostgresListStore) loadEntries(ctx context.Context, lists []*List) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	ids := make([]int64, 0, len(lists))
+	byID := make(map[int]*List, len(lists))
+	for _, list := range lists {
+		ids = append(ids, int64(list.ID))
+		byID[list.ID] = list
+		list.Entries = []ListEntry{}
+	}
+
+	query :=
+		`SELECT list_id, ` + entryColumns + ` FROM list_entries WHERE list_id = ANY($1) ORDER BY list_id, order_index`
+
+	rows, err := s.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var entry ListEntry
-		err = rows.Scan(
-			&entry.ID,
-			&entry.Title,
-			&entry.OrderIndex,
-		)
+		var listID int
+		err = rows.Scan(append([]interface{}{&listID}, entryScanTargets(&entry)...)...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
+		list := byID[listID]
 		list.Entries = append(list.Entries, entry)
 	}
 
-	return list, nil
+	return rows.Err()
 }
 
-func (s *PostgresListStore) UpdateList(list *List) error {
-	tx, err := s.db.Begin()
+// UpdateList saves the list and replaces its entries with list.Entries.
+// Entries whose ID already belongs to the list are updated in place so they
+// keep their IDs, entries without one are inserted, and any entries left out
+// are deleted. A revision authored by authorID is recorded with the change.
+//
+// The update only applies if the list is still at list.Version, otherwise
+// ErrEditConflict is returned. On success list.Version holds the new version.
+func (s *PostgresListStore) UpdateList(ctx context.Context, list *List, authorID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	existing, err := lockEntryOrder(ctx, tx, int64(list.ID))
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE lists SET title = $1, description = $2, visibility = $3, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version`
+
+	err = tx.QueryRowContext(ctx, query, list.Title, list.Description, list.Visibility, list.ID, list.Version).Scan(&list.UpdatedAt, &list.Version)
+	if err == sql.ErrNoRows {
+		return ErrEditConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	normaliseEntryOrder(list.Entries)
+
+	kept := make([]int64, 0, len(list.Entries))
+	for i := range list.Entries {
+		entry := &list.Entries[i]
+		if entry.ID != 0 && indexOfEntry(existing, int64(entry.ID)) != -1 && indexOfEntry(kept, int64(entry.ID)) == -1 {
+			err = updateEntry(ctx, tx, int64(list.ID), entry)
+		} else {
+			err = insertEntry(ctx, tx, int64(list.ID), entry)
+		}
+		if err != nil {
+			return err
+		}
+
+		kept = append(kept, int64(entry.ID))
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM list_entries WHERE list_id = $1 AND id <> ALL($2::bigint[])`, list.ID, kept)
+	if err != nil {
+		return err
+	}
+
+	err = applyEntryOrder(ctx, tx, int64(list.ID), kept)
+	if err != nil {
+		return err
+	}
+
+	err = recordRevision(ctx, tx, list, authorID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteList moves a list to the trash. Trashed lists are hidden everywhere
+// except GetTrashedLists until they are restored or purged.
+//
+// A version other than 0 makes the delete conditional: if the list is no
+// longer at that version ErrEditConflict is returned. sql.ErrNoRows is
+// returned if the list does not exist or is already in the trash.
+func (s *PostgresListStore) DeleteList(ctx context.Context, id int64, version int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	query :=
-		`UPDATE lists SET title = $1, description = $2 WHERE id = $3`
+		`UPDATE lists SET deleted_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2)`
 
-	result, err := tx.Exec(query, list.Title, list.Description, list.ID)
+	result, err := s.db.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -126,34 +534,89 @@ func (s *PostgresListStore) UpdateList(list *List) error {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	if rowsAffected > 0 {
+		return nil
 	}
 
-	_, err = tx.Exec(`DELETE FROM list_entries WHERE list_id = $1`, list.ID)
+	var exists bool
+	err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM lists WHERE id = $1 AND deleted_at IS NULL)`, id).Scan(&exists)
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range list.Entries {
-		query := `
-			INSERT INTO list_entries (title, order_index, list_id, user_id) 
-			VALUES ($1, $2, $3, $4)`
+	if exists {
+		return ErrEditConflict
+	}
+
+	return sql.ErrNoRows
+}
+
+func (s *PostgresListStore) GetListOwner(ctx context.Context, id int64) (int, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var userID int
+
+	query :=
+		`SELECT user_id FROM lists WHERE id = $1 AND deleted_at IS NULL`
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
 
-		_, err := tx.Exec(query, entry.Title, entry.OrderIndex, list.ID, list.UserID)
+// GetTrashedLists returns the trashed lists userID owns, most recently
+// deleted first.
+func (s *PostgresListStore) GetTrashedLists(ctx context.Context, userID int) ([]*List, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT ` + listColumns + `
+		FROM lists
+		WHERE deleted_at IS NOT NULL AND EXISTS (
+			SELECT 1 FROM list_members m
+			WHERE m.list_id = lists.id AND m.user_id = $1 AND m.role = 'owner'
+		)
+		ORDER BY deleted_at DESC, id DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []*List{}
+	for rows.Next() {
+		list := &List{}
+		err = rows.Scan(listScanTargets(list)...)
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		lists = append(lists, list)
 	}
 
-	return tx.Commit()
+	return lists, rows.Err()
 }
 
-func (s *PostgresListStore) DeleteList(id int64) error {
-	query :=
-		`DELETE from lists WHERE id = $1`
+// RestoreList takes a list out of the trash. Only an owner of the list may
+// restore it; anyone else gets sql.ErrNoRows, as if the list did not exist.
+func (s *PostgresListStore) RestoreList(ctx context.Context, id int64, userID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE lists SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL AND EXISTS (
+			SELECT 1 FROM list_members m
+			WHERE m.list_id = lists.id AND m.user_id = $2 AND m.role = 'owner'
+		)`
 
-	result, err := s.db.Exec(query, id)
+	result, err := s.db.ExecContext(ctx, query, id, userID)
 	if err != nil {
 		return err
 	}
@@ -170,16 +633,16 @@ func (s *PostgresListStore) DeleteList(id int64) error {
 	return nil
 }
 
-func (s *PostgresListStore) GetListOwner(id int64) (int, error) {
-	var userID int
-
-	query :=
-		`SELECT user_id FROM lists WHERE id = $1`
+// PurgeDeletedLists permanently deletes lists that have been in the trash
+// since before the cutoff, along with their entries.
+func (s *PostgresListStore) PurgeDeletedLists(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
 
-	err := s.db.QueryRow(query, id).Scan(&userID)
+	result, err := s.db.ExecContext(ctx, `DELETE FROM lists WHERE deleted_at < $1`, cutoff)
 	if err != nil {
 		return 0, err
 	}
 
-	return userID, nil
+	return result.RowsAffected()
 }
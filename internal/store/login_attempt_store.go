@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LoginPolicy decides how long a key is locked out after repeated failed
+// logins. The first FreeAttempts failures are not penalised; after that each
+// failure doubles the lockout, starting from BaseLockout, up to MaxLockout.
+// Failures are forgotten after ResetAfter without a new one.
+type LoginPolicy struct {
+	FreeAttempts int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	ResetAfter   time.Duration
+}
+
+// Lockout returns how long to lock a key out for after failures consecutive
+// failed logins.
+func (p LoginPolicy) Lockout(failures int) time.Duration {
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	shift := failures - p.FreeAttempts
+	if shift >= 32 {
+		return p.MaxLockout
+	}
+
+	lockout := p.BaseLockout << shift
+	if lockout <= 0 || lockout > p.MaxLockout {
+		return p.MaxLockout
+	}
+
+	return lockout
+}
+
+// Lockout is a key that is currently locked out of logging in.
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type PostgresLoginAttemptStore struct {
+	db *sql.DB
+	queryTimeout
+}
+
+func NewPostgresLoginAttemptStore(db *sql.DB, timeout time.Duration) *PostgresLoginAttemptStore {
+	return &PostgresLoginAttemptStore{db: db, queryTimeout: queryTimeout(timeout)}
+}
+
+type LoginAttemptStore interface {
+	GetLockedUntil(ctx context.Context, keys []string) (*time.Time, error)
+	RecordFailure(ctx context.Context, key string, policy LoginPolicy) (*time.Time, error)
+	ResetAttempts(ctx context.Context, key string) error
+	GetLockouts(ctx context.Context) ([]Lockout, error)
+}
+
+// GetLockedUntil returns when the latest lockout of any of keys ends, or nil
+// if none of them is locked out.
+func (s *PostgresLoginAttemptStore) GetLockedUntil(ctx context.Context, keys []string) (*time.Time, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var lockedUntil *time.Time
+
+	query :=
+		`SELECT MAX(locked_until) FROM login_attempts WHERE key = ANY($1) AND locked_until > $2`
+
+	err := s.db.QueryRowContext(ctx, query, keys, time.Now()).Scan(&lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	return lockedUntil, nil
+}
+
+// RecordFailure counts a failed login for key and locks it out as policy
+// requires. It returns the end of the lockout, or nil if key is not locked.
+func (s *PostgresLoginAttemptStore) RecordFailure(ctx context.Context, key string, policy LoginPolicy) (*time.Time, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at < $3 THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = $2
+		RETURNING failures`
+
+	var failures int
+	err := s.db.QueryRowContext(ctx, query, key, now, now.Add(-policy.ResetAfter)).Scan(&failures)
+	if err != nil {
+		return nil, err
+	}
+
+	lockout := policy.Lockout(failures)
+	if lockout == 0 {
+		return nil, nil
+	}
+
+	lockedUntil := now.Add(lockout)
+	_, err = s.db.ExecContext(ctx, `UPDATE login_attempts SET locked_until = $1 WHERE key = $2`, lockedUntil, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockedUntil, nil
+}
+
+// ResetAttempts forgets the failed logins of key, lifting any lockout. It
+// returns sql.ErrNoRows if key has no failed logins.
+func (s *PostgresLoginAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *PostgresLoginAttemptStore) GetLockouts(ctx context.Context) ([]Lockout, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT key, failures, locked_until
+		FROM login_attempts
+		WHERE locked_until > $1
+		ORDER BY locked_until DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []Lockout{}
+	for rows.Next() {
+		var lockout Lockout
+		err = rows.Scan(&lockout.Key, &lockout.Failures, &lockout.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+
+		lockouts = append(lockouts, lockout)
+	}
+
+	return lockouts, rows.Err()
+}
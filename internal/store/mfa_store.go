@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// TOTPSettings is a user's two-factor state. Secret is set once enrollment
+// has started and Enabled once it has been confirmed with a valid code.
+type TOTPSettings struct {
+	Secret   *string
+	Enabled  bool
+	LastStep *int64
+}
+
+func (s *PostgresUserStore) GetTOTP(ctx context.Context, userID int) (*TOTPSettings, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	settings := &TOTPSettings{}
+
+	query :=
+		`SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1`
+
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&settings.Secret, &settings.Enabled, &settings.LastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// StartTOTPEnrollment stores a new, not yet confirmed secret. It returns
+// sql.ErrNoRows if two-factor authentication is already enabled.
+func (s *PostgresUserStore) StartTOTPEnrollment(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query :=
+		`UPDATE users SET totp_secret = $1, totp_last_step = NULL WHERE id = $2 AND NOT totp_enabled`
+
+	result, err := s.db.ExecContext(ctx, query, secret, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// EnableTOTP confirms enrollment, records the time step of the confirming code
+// and replaces the user's recovery codes with recoveryHashes.
+func (s *PostgresUserStore) EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query :=
+		`UPDATE users SET totp_enabled = true, totp_last_step = $1 WHERE id = $2 AND totp_secret IS NOT NULL AND NOT totp_enabled`
+
+	result, err := tx.ExecContext(ctx, query, step, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresUserStore) DisableTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query :=
+		`UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_step = NULL WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordTOTPStep accepts a code's time step if it is newer than the last one
+// used, so each code works only once. It reports whether the step was
+// accepted.
+func (s *PostgresUserStore) RecordTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query :=
+		`UPDATE users SET totp_last_step = $1 WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`
+
+	result, err := s.db.ExecContext(ctx, query, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode marks the unused recovery code with hash as used and
+// reports whether there was one.
+func (s *PostgresUserStore) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query :=
+		`UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	result, err := s.db.ExecContext(ctx, query, userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
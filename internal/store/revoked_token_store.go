@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/mikemcavoydev/list-api/internal/tokens"
+)
+
+// PostgresRevokedTokenStore records revoked access JWTs until they expire,
+// so every server can add them to its denylist.
+type PostgresRevokedTokenStore struct {
+	db *sql.DB
+	queryTimeout
+}
+
+func NewPostgresRevokedTokenStore(db *sql.DB, timeout time.Duration) *PostgresRevokedTokenStore {
+	return &PostgresRevokedTokenStore{db: db, queryTimeout: queryTimeout(timeout)}
+}
+
+type RevokedTokenStore interface {
+	Revoke(ctx context.Context, jti string, expiry time.Time) error
+	GetRevoked(ctx context.Context) (map[string]time.Time, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+func (s *PostgresRevokedTokenStore) Revoke(ctx context.Context, jti string, expiry time.Time) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query :=
+		`INSERT INTO revoked_tokens (jti, expiry) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+
+	_, err := s.db.ExecContext(ctx, query, jti, expiry)
+	return err
+}
+
+// GetRevoked returns the revoked tokens that have not expired yet, with
+// their expiry.
+func (s *PostgresRevokedTokenStore) GetRevoked(ctx context.Context) (map[string]time.Time, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT jti, expiry FROM revoked_tokens WHERE expiry > $1`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := map[string]time.Time{}
+	for rows.Next() {
+		var (
+			jti    string
+			expiry time.Time
+		)
+
+		err = rows.Scan(&jti, &expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		revoked[jti] = expiry
+	}
+
+	return revoked, rows.Err()
+}
+
+// DeleteExpired forgets revocations of tokens that have expired anyway.
+func (s *PostgresRevokedTokenStore) DeleteExpired(ctx context.Context) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expiry <= $1`, time.Now())
+	return err
+}
+
+// revokeAccessJWTs records the access JWTs issued for the unexpired access
+// tokens matching condition as revoked. It has to run before those tokens
+// are deleted, in the same transaction, so signing a session out also stops
+// its JWTs once the servers' denylists are synced. The JWT ID is the
+// unpadded base64url encoding of the token's hash, as in signAccessToken.
+func revokeAccessJWTs(ctx context.Context, db tokenExecer, condition string, args ...interface{}) error {
+	query := `
+		INSERT INTO revoked_tokens (jti, expiry)
+		SELECT translate(rtrim(encode(hash, 'base64'), '='), '+/', '-_'), expiry
+		FROM tokens
+		WHERE scope = '` + tokens.ScopeAuth + `' AND expiry > CURRENT_TIMESTAMP AND (` + condition + `)
+		ON CONFLICT (jti) DO NOTHING`
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
@@ -1,7 +1,10 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/mikemcavoydev/list-api/internal/tokens"
@@ -9,44 +12,438 @@ import (
 
 type PostgresTokenStore struct {
 	DB *sql.DB
+	queryTimeout
 }
 
-func NewPostgresTokenStore(db *sql.DB) *PostgresTokenStore {
+func NewPostgresTokenStore(db *sql.DB, timeout time.Duration) *PostgresTokenStore {
 	return &PostgresTokenStore{
-		DB: db,
+		DB:           db,
+		queryTimeout: queryTimeout(timeout),
 	}
 }
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// Session describes an active token without exposing the token itself.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
+// PersonalToken is a named, long-lived token a user creates for automation.
+// Token holds the plaintext only in the response that creates it.
+type PersonalToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
 type TokenStore interface {
-	Insert(token *tokens.Token) error
-	CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error)
-	DeleteAllTokensForUser(userID int, scope string) error
+	Insert(ctx context.Context, token *tokens.Token) error
+	InsertPair(ctx context.Context, access, refresh *tokens.Token) error
+	RotateRefreshToken(ctx context.Context, plaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error)
+	CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*tokens.Token, error)
+	DeleteAllTokensForUser(ctx context.Context, userID int, scope string) error
+	DeleteToken(ctx context.Context, hash []byte) error
+	DeleteTokenForUser(ctx context.Context, id int64, userID int, scope string) error
+	GetSessionsForUser(ctx context.Context, userID int, scope string, currentHash []byte) ([]Session, error)
+	CreatePersonalToken(ctx context.Context, userID int, token *PersonalToken) error
+	GetPersonalTokensForUser(ctx context.Context, userID int) ([]PersonalToken, error)
+	GetLatestTokenCreatedAt(ctx context.Context, userID int, scope string) (*time.Time, error)
 }
 
-func (s *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+func (s *PostgresTokenStore) CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	token, err := tokens.GenerateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.Insert(token)
+	err = s.Insert(ctx, token)
 	return token, err
 }
 
-func (s *PostgresTokenStore) Insert(token *tokens.Token) error {
+type tokenExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertToken(ctx context.Context, db tokenExecer, token *tokens.Token) error {
 	query :=
-		`INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`
+		`INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)`
 
-	_, err := s.DB.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	_, err := db.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.UserAgent, token.IP)
 
 	return err
 }
 
-func (s *PostgresTokenStore) DeleteAllTokensForUser(userID int, scope string) error {
+// CreatePersonalToken generates and stores a personal access token, filling
+// in its id, plaintext and creation time. A nil ExpiresAt never expires.
+func (s *PostgresTokenStore) CreatePersonalToken(ctx context.Context, userID int, token *PersonalToken) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	generated, err := tokens.GenerateToken(userID, 0, tokens.ScopePersonal)
+	if err != nil {
+		return err
+	}
+
+	query :=
+		`INSERT INTO tokens (hash, user_id, expiry, scope, name, permissions)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	err = s.DB.QueryRowContext(
+		ctx, query, generated.Hash, userID, token.ExpiresAt, tokens.ScopePersonal, token.Name, strings.Join(token.Scopes, " "),
+	).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	token.Token = generated.Plaintext
+	return nil
+}
+
+// GetPersonalTokensForUser returns the user's unexpired personal access
+// tokens, newest first.
+func (s *PostgresTokenStore) GetPersonalTokensForUser(ctx context.Context, userID int) ([]PersonalToken, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT id, name, permissions, created_at, last_used_at, expiry
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND (expiry IS NULL OR expiry > $3)
+		ORDER BY created_at DESC, id DESC`
+
+	rows, err := s.DB.QueryContext(ctx, query, userID, tokens.ScopePersonal, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	personalTokens := []PersonalToken{}
+	for rows.Next() {
+		var (
+			token       PersonalToken
+			permissions string
+		)
+
+		err = rows.Scan(&token.ID, &token.Name, &permissions, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		token.Scopes = strings.Fields(permissions)
+		personalTokens = append(personalTokens, token)
+	}
+
+	return personalTokens, rows.Err()
+}
+
+func (s *PostgresTokenStore) Insert(ctx context.Context, token *tokens.Token) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	return insertToken(ctx, s.DB, token)
+}
+
+// InsertPair stores an access token together with its refresh token.
+func (s *PostgresTokenStore) InsertPair(ctx context.Context, access, refresh *tokens.Token) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, token := range []*tokens.Token{access, refresh} {
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access and refresh
+// token in the same family. Each refresh token can be used once; presenting
+// one again means it has leaked, so every token of its family is revoked and
+// ErrRefreshTokenReused is returned.
+func (s *PostgresTokenStore) RotateRefreshToken(ctx context.Context, plaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*tokens.Token, *tokens.Token, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID int
+		family string
+		expiry time.Time
+		usedAt *time.Time
+	)
+
+	query := `
+		SELECT user_id, family, expiry, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, tokens.Hash(plaintext), tokens.ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if usedAt != nil {
+		err = revokeAccessJWTs(ctx, tx, `family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	if !expiry.After(time.Now()) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = CURRENT_TIMESTAMP WHERE hash = $1`, tokens.Hash(plaintext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := tokens.GeneratePair(userID, family, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*tokens.Token{access, refresh} {
+		token.UserAgent = userAgent
+		token.IP = ip
+
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// DeleteAllTokensForUser revokes the user's tokens of scope. Deleting access
+// tokens revokes the JWTs issued for them too.
+func (s *PostgresTokenStore) DeleteAllTokensForUser(ctx context.Context, userID int, scope string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeAccessJWTs(ctx, tx, `scope = $1 AND user_id = $2`, scope, userID)
+	if err != nil {
+		return err
+	}
+
 	query :=
 		`DELETE FROM tokens WHERE Scope = $1 AND user_id = $2`
 
-	_, err := s.DB.Exec(query, scope, userID)
+	_, err = tx.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return tx.Commit()
+}
+
+// DeleteToken revokes the token stored under hash along with the rest of its
+// family, including the JWTs issued for its access tokens. It returns
+// sql.ErrNoRows if no such token exists.
+func (s *PostgresTokenStore) DeleteToken(ctx context.Context, hash []byte) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	condition := `hash = $1 OR family = (SELECT family FROM tokens WHERE hash = $1)`
+
+	err = revokeAccessJWTs(ctx, tx, condition, hash)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE `+condition, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// DeleteTokenForUser revokes one of the user's tokens by its id, along with
+// the rest of its family and the JWTs issued for its access tokens. It
+// returns sql.ErrNoRows if the user has no such token.
+func (s *PostgresTokenStore) DeleteTokenForUser(ctx context.Context, id int64, userID int, scope string) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeAccessJWTs(ctx, tx,
+		`(id = $1 AND user_id = $2 AND scope = $3) OR family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3)`,
+		id, userID, scope)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		WITH target AS (
+			SELECT hash, family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3
+		)
+		DELETE FROM tokens t
+		USING target
+		WHERE t.hash = target.hash OR t.family = target.family`
+
+	result, err := tx.ExecContext(ctx, query, id, userID, scope)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// GetSessionsForUser returns the user's sessions, most recently used first.
+// Refreshing a session adds a token to its family, so each family of
+// unexpired tokens of scope is one session, shown by its newest token but
+// created when the family's first token was. The session holding the token
+// stored under currentHash is marked current.
+func (s *PostgresTokenStore) GetSessionsForUser(ctx context.Context, userID int, scope string, currentHash []byte) ([]Session, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT id, created_at, last_used_at, expiry, user_agent, ip, is_current
+		FROM (
+			SELECT DISTINCT ON (COALESCE(family, id::text))
+				id,
+				MIN(created_at) OVER family_tokens AS created_at,
+				MAX(last_used_at) OVER family_tokens AS last_used_at,
+				expiry,
+				user_agent,
+				ip,
+				COALESCE(bool_or(hash = $4) OVER family_tokens, false) AS is_current
+			FROM tokens
+			WHERE user_id = $1 AND scope = $2 AND expiry > $3
+			WINDOW family_tokens AS (PARTITION BY COALESCE(family, id::text))
+			ORDER BY COALESCE(family, id::text), tokens.created_at DESC, tokens.id DESC
+		) sessions
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC`
+
+	rows, err := s.DB.QueryContext(ctx, query, userID, scope, time.Now(), currentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// GetLatestTokenCreatedAt returns when the user's newest token of scope was
+// created, or nil if they have none.
+func (s *PostgresTokenStore) GetLatestTokenCreatedAt(ctx context.Context, userID int, scope string) (*time.Time, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var createdAt *time.Time
+
+	query :=
+		`SELECT MAX(created_at) FROM tokens WHERE user_id = $1 AND scope = $2`
+
+	err := s.DB.QueryRowContext(ctx, query, userID, scope).Scan(&createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return createdAt, nil
 }
@@ -1,12 +1,16 @@
 package store
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgconn"
+	"github.com/mikemcavoydev/list-api/internal/passwords"
+	"github.com/mikemcavoydev/list-api/internal/tokens"
 )
 
 type password struct {
@@ -14,87 +18,237 @@ type password struct {
 	hash      []byte
 }
 
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
-	if err != nil {
-		return err
-	}
-
-	p.plainText = &plaintextPassword
-	p.hash = hash
-	return nil
-}
-
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-
-	return true, nil
-}
-
 type User struct {
 	ID           int       `json:"id"`
 	Username     string    `json:"username"`
 	Email        string    `json:"email"`
 	PasswordHash password  `json:"-"`
+	Activated    bool      `json:"activated"`
+	Admin        bool      `json:"admin"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 var AnonymousUser = &User{}
 
+// uniqueViolation is the Postgres error code for unique_violation.
+const uniqueViolation = "23505"
+
+var (
+	ErrDuplicateUsername = errors.New("a user with that username already exists")
+	ErrDuplicateEmail    = errors.New("a user with that email already exists")
+)
+
+// uniqueUserError turns unique violations on the users table into
+// ErrDuplicateUsername or ErrDuplicateEmail.
+func uniqueUserError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return err
+	}
+
+	switch pgErr.ConstraintName {
+	case "users_username_key":
+		return ErrDuplicateUsername
+	case "users_email_key":
+		return ErrDuplicateEmail
+	}
+
+	return err
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
 type UserStore interface {
-	CreateUser(user *User) error
-	GetUserByUsername(username string) (*User, error)
-	UpdateUser(user *User) error
-	GetUserToken(scope, token string) (*User, error)
+	CreateUser(ctx context.Context, user *User) error
+	CreateUserWithActivationToken(ctx context.Context, user *User, ttl time.Duration) (*tokens.Token, error)
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	UpdateUser(ctx context.Context, user *User) error
+	UpdatePassword(ctx context.Context, user *User) error
+	RehashPassword(ctx context.Context, user *User) error
+	ActivateUser(ctx context.Context, user *User) error
+	DeleteUser(ctx context.Context, id int) error
+	GetTOTP(ctx context.Context, userID int) (*TOTPSettings, error)
+	StartTOTPEnrollment(ctx context.Context, userID int, secret string) error
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes [][]byte) error
+	DisableTOTP(ctx context.Context, userID int) error
+	RecordTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error)
+	GetUserToken(ctx context.Context, scope, token string) (*User, error)
+	ConsumeUserToken(ctx context.Context, scope, token string) (*User, error)
+	GetUserByAccessToken(ctx context.Context, token string) (*User, []string, error)
+	SetPassword(user *User, plaintextPassword string) error
+	PasswordMatches(user *User, plaintextPassword string) (bool, error)
+	PasswordNeedsRehash(user *User) bool
+	DummyPasswordCheck(plaintextPassword string)
 }
 
 type PostgresUserStore struct {
-	db *sql.DB
+	db        *sql.DB
+	passwords *passwords.Manager
+	queryTimeout
 }
 
-func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
+// NewPostgresUserStore returns a user store that hashes and verifies
+// passwords with manager. Hashes made with other supported algorithms or
+// parameters keep verifying and are reported by PasswordNeedsRehash.
+func NewPostgresUserStore(db *sql.DB, manager *passwords.Manager, timeout time.Duration) *PostgresUserStore {
 	return &PostgresUserStore{
-		db: db,
+		db:           db,
+		passwords:    manager,
+		queryTimeout: queryTimeout(timeout),
 	}
 }
 
-func (s *PostgresUserStore) CreateUser(user *User) error {
+// SetPassword hashes plaintextPassword as the user's new password. It is
+// only stored once the user is created or UpdatePassword is called.
+func (s *PostgresUserStore) SetPassword(user *User, plaintextPassword string) error {
+	hash, err := s.passwords.Hash(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	user.PasswordHash.plainText = &plaintextPassword
+	user.PasswordHash.hash = []byte(hash)
+	return nil
+}
+
+func (s *PostgresUserStore) PasswordMatches(user *User, plaintextPassword string) (bool, error) {
+	return s.passwords.Verify(plaintextPassword, string(user.PasswordHash.hash))
+}
+
+// PasswordNeedsRehash reports whether the user's hash was made with an
+// algorithm or parameters other than the current ones.
+func (s *PostgresUserStore) PasswordNeedsRehash(user *User) bool {
+	return s.passwords.NeedsRehash(string(user.PasswordHash.hash))
+}
+
+// DummyPasswordCheck takes as long as checking a real password. Logins for
+// unknown users call it so their response time does not reveal that the user
+// does not exist.
+func (s *PostgresUserStore) DummyPasswordCheck(plaintextPassword string) {
+	s.passwords.DummyVerify(plaintextPassword)
+}
+
+func (s *PostgresUserStore) CreateUser(ctx context.Context, user *User) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	query :=
-		`INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at`
+		`INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id, activated, admin, created_at, updated_at`
 
-	err := s.db.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash).Scan(
-		&user.ID, &user.CreatedAt, &user.UpdatedAt,
+	err := s.db.QueryRowContext(ctx, query, user.Username, user.Email, user.PasswordHash.hash).Scan(
+		&user.ID, &user.Activated, &user.Admin, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err != nil {
-		return err
+		return uniqueUserError(err)
 	}
 
 	return nil
 }
 
-func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
+// CreateUserWithActivationToken creates the user together with an activation
+// token valid for ttl, so a user is never left without a way to activate.
+func (s *PostgresUserStore) CreateUserWithActivationToken(ctx context.Context, user *User, ttl time.Duration) (*tokens.Token, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query :=
+		`INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id, activated, admin, created_at, updated_at`
+
+	err = tx.QueryRowContext(ctx, query, user.Username, user.Email, user.PasswordHash.hash).Scan(
+		&user.ID, &user.Activated, &user.Admin, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, uniqueUserError(err)
+	}
+
+	token, err := tokens.GenerateToken(user.ID, ttl, tokens.ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+func (s *PostgresUserStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query :=
+		`SELECT id, username, email, password_hash, activated, admin, created_at, updated_at FROM users WHERE id = $1`
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.Activated, &user.Admin, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query :=
+		`SELECT id, username, email, password_hash, activated, admin, created_at, updated_at FROM users WHERE username = $1`
+
+	err := s.db.QueryRowContext(ctx, query, username).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.Activated, &user.Admin, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	user := &User{
 		PasswordHash: password{},
 	}
 
 	query :=
-		`SELECT id, username, email, password_hash, created_at, updated_at FROM users WHERE username = $1`
+		`SELECT id, username, email, password_hash, activated, admin, created_at, updated_at FROM users WHERE email = $1`
 
-	err := s.db.QueryRow(query, username).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.CreatedAt, &user.UpdatedAt,
+	err := s.db.QueryRowContext(ctx, query, email).Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.Activated, &user.Admin, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -107,11 +261,149 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 	return user, nil
 }
 
-func (s *PostgresUserStore) UpdateUser(user *User) error {
+// UpdatePassword saves the user's password hash and revokes every token the
+// user holds, and the JWTs issued for them, signing them out everywhere.
+func (s *PostgresUserStore) UpdatePassword(ctx context.Context, user *User) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query :=
-		`UPDATE users SET username = $1, email = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3 RETURNING updated_at`
+		`UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 RETURNING updated_at`
 
-	result, err := s.db.Exec(query, user.Username, user.Email, user.ID)
+	err = tx.QueryRowContext(ctx, query, user.PasswordHash.hash, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = revokeAccessJWTs(ctx, tx, `user_id = $1`, user.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RehashPassword saves a new hash of the user's unchanged password. Unlike
+// UpdatePassword it leaves the user's tokens alone.
+func (s *PostgresUserStore) RehashPassword(ctx context.Context, user *User) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET password_hash = $1 WHERE id = $2`, user.PasswordHash.hash, user.ID)
+	return err
+}
+
+// ActivateUser marks the user's email as verified and removes their remaining
+// activation tokens.
+func (s *PostgresUserStore) ActivateUser(ctx context.Context, user *User) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query :=
+		`UPDATE users SET activated = true, updated_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING updated_at`
+
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	user.Activated = true
+	return tx.Commit()
+}
+
+// UpdateUser saves the user's username, email and activation state. It
+// returns ErrDuplicateUsername or ErrDuplicateEmail if another user already
+// has the new username or email.
+func (s *PostgresUserStore) UpdateUser(ctx context.Context, user *User) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	query :=
+		`UPDATE users SET username = $1, email = $2, activated = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $4 RETURNING updated_at`
+
+	err := s.db.QueryRowContext(ctx, query, user.Username, user.Email, user.Activated, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		return uniqueUserError(err)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes a user along with their tokens and list memberships,
+// and revokes the JWTs issued for their tokens. Lists the user is the only
+// owner of are deleted too; lists they created that have other owners are
+// handed over to one of them, so shared lists survive and always keep an
+// owner.
+func (s *PostgresUserStore) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeAccessJWTs(ctx, tx, `user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		DELETE FROM lists l
+		WHERE EXISTS (
+			SELECT 1 FROM list_members m
+			WHERE m.list_id = l.id AND m.user_id = $1 AND m.role = 'owner'
+		) AND NOT EXISTS (
+			SELECT 1 FROM list_members m
+			WHERE m.list_id = l.id AND m.user_id <> $1 AND m.role = 'owner'
+		)`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE lists l SET user_id = (
+			SELECT m.user_id FROM list_members m
+			WHERE m.list_id = l.id AND m.user_id <> $1 AND m.role = 'owner'
+			ORDER BY m.created_at, m.user_id
+			LIMIT 1
+		)
+		WHERE l.user_id = $1 AND EXISTS (
+			SELECT 1 FROM list_members m
+			WHERE m.list_id = l.id AND m.user_id <> $1 AND m.role = 'owner'
+		)`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
 	if err != nil {
 		return err
 	}
@@ -125,27 +417,74 @@ func (s *PostgresUserStore) UpdateUser(user *User) error {
 		return sql.ErrNoRows
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (s *PostgresUserStore) GetUserToken(scope, token string) (*User, error) {
+// GetUserToken returns the owner of an unexpired token and records that the
+// token was used.
+func (s *PostgresUserStore) GetUserToken(ctx context.Context, scope, token string) (*User, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	query :=
+		`UPDATE tokens t SET last_used_at = CURRENT_TIMESTAMP
+		FROM users u
+		WHERE t.user_id = u.id AND t.hash = $1 AND t.scope = $2 AND t.expiry > $3
+		RETURNING u.id, u.username, u.email, u.password_hash, u.activated, u.admin, u.created_at, u.updated_at`
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	err := s.db.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Activated,
+		&user.Admin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ConsumeUserToken deletes an unexpired token and returns its owner, or nil if
+// there is no such token. Of concurrent calls with the same token only one
+// gets the user, so single use tokens cannot be used twice.
+func (s *PostgresUserStore) ConsumeUserToken(ctx context.Context, scope, token string) (*User, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
 	tokenHash := sha256.Sum256([]byte(token))
 
 	query :=
-		`SELECT u.id, u.username, u.email, u.password_hash, u.created_at, u.updated_at
-		FROM users u 
-		INNER JOIN tokens t ON t.user_id = u.id
-		WHERE t.hash = $1 AND t.scope = $2 AND t.expiry > $3`
+		`DELETE FROM tokens t
+		USING users u
+		WHERE t.user_id = u.id AND t.hash = $1 AND t.scope = $2 AND t.expiry > $3
+		RETURNING u.id, u.username, u.email, u.password_hash, u.activated, u.admin, u.created_at, u.updated_at`
 
 	user := &User{
 		PasswordHash: password{},
 	}
 
-	err := s.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(
+	err := s.db.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
 		&user.PasswordHash.hash,
+		&user.Activated,
+		&user.Admin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -159,3 +498,49 @@ func (s *PostgresUserStore) GetUserToken(scope, token string) (*User, error) {
 
 	return user, nil
 }
+
+// GetUserByAccessToken returns the owner of an unexpired session or personal
+// access token, along with the permissions of a personal access token. The
+// permissions are nil for session tokens. The token is recorded as used.
+func (s *PostgresUserStore) GetUserByAccessToken(ctx context.Context, token string) (*User, []string, error) {
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	query :=
+		`UPDATE tokens t SET last_used_at = CURRENT_TIMESTAMP
+		FROM users u
+		WHERE t.user_id = u.id AND t.hash = $1 AND t.scope IN ($2, $3) AND (t.expiry IS NULL OR t.expiry > $4)
+		RETURNING u.id, u.username, u.email, u.password_hash, u.activated, u.admin, u.created_at, u.updated_at, t.permissions`
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	var permissions sql.NullString
+	err := s.db.QueryRowContext(ctx, query, tokenHash[:], tokens.ScopeAuth, tokens.ScopePersonal, time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Activated,
+		&user.Admin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&permissions,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !permissions.Valid {
+		return user, nil, nil
+	}
+
+	return user, strings.Fields(permissions.String), nil
+}
@@ -1,16 +1,29 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"os"
 	"testing"
+	"time"
 
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/mikemcavoydev/list-api/internal/config"
+	"github.com/mikemcavoydev/list-api/internal/passwords"
+	"github.com/mikemcavoydev/list-api/internal/tokens"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// setupTestDB connects to the database in LIST_API_TEST_DB_DSN, or to the
+// default database if it is unset.
 func setupTestDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("pgx", "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable")
+	cfg := config.Default().DB
+	if dsn := os.Getenv("LIST_API_TEST_DB_DSN"); dsn != "" {
+		cfg.DSN = dsn
+	}
+
+	db, err := Open(cfg)
 	if err != nil {
 		t.Fatalf("opening test db error: %v", err)
 	}
@@ -20,7 +33,7 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("migrating test db error: %v", err)
 	}
 
-	_, err = db.Exec(`TRUNCATE lists, list_entries CASCADE`)
+	_, err = db.Exec(`TRUNCATE users, lists, list_entries, list_members, login_attempts, revoked_tokens CASCADE`)
 	if err != nil {
 		t.Fatalf("truncating tables error: %v", err)
 	}
@@ -28,11 +41,33 @@ func setupTestDB(t *testing.T) *sql.DB {
 	return db
 }
 
+// testPasswords hashes the passwords of the users the tests create.
+var testPasswords = passwords.NewManager(passwords.BcryptHasher{Cost: 12})
+
+// testQueryTimeout is the default query timeout.
+var testQueryTimeout = config.Default().DB.QueryTimeout
+
+func createTestUser(t *testing.T, db *sql.DB, username string) *User {
+	user := &User{
+		Username: username,
+		Email:    username + "@example.com",
+	}
+
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	err := userStore.SetPassword(user, "password")
+	require.NoError(t, err)
+
+	err = userStore.CreateUser(t.Context(), user)
+	require.NoError(t, err)
+
+	return user
+}
+
 func TestCreateList(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
-	store := NewPostgresListStore(db)
+	store := NewPostgresListStore(db, testQueryTimeout)
 
 	tests := []struct {
 		name    string
@@ -61,7 +96,7 @@ func TestCreateList(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			createdList, err := store.CreateList(tt.list)
+			createdList, err := store.CreateList(t.Context(), tt.list)
 			if tt.wantErr {
 				assert.Error(t, err)
 				return
@@ -71,7 +106,7 @@ func TestCreateList(t *testing.T) {
 			assert.Equal(t, tt.list.Title, createdList.Title)
 			assert.Equal(t, tt.list.Description, createdList.Description)
 
-			retrieved, err := store.GetListByID(int64(createdList.ID))
+			retrieved, err := store.GetListByID(t.Context(), int64(createdList.ID))
 			require.NoError(t, err)
 
 			assert.Equal(t, createdList.ID, retrieved.ID)
@@ -84,3 +119,965 @@ func TestCreateList(t *testing.T) {
 		})
 	}
 }
+
+func TestGetListsForUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+	other := createTestUser(t, db, "other")
+
+	for _, title := range []string{"Groceries", "Books", "Gifts"} {
+		_, err := store.CreateList(t.Context(), &List{
+			Title:   title,
+			UserID:  owner.ID,
+			Entries: []ListEntry{{Title: title + " entry", OrderIndex: 0}},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := store.CreateList(t.Context(), &List{Title: "Not mine", UserID: other.ID})
+	require.NoError(t, err)
+
+	shared, err := store.CreateList(t.Context(), &List{Title: "Shared", UserID: other.ID})
+	require.NoError(t, err)
+	require.NoError(t, store.AddListMember(t.Context(), int64(shared.ID), owner.ID, RoleViewer))
+
+	otherLists, _, err := store.GetListsForUser(t.Context(), other.ID, ListFilter{Sort: "title", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, otherLists, 2)
+
+	firstPage, cursor, err := store.GetListsForUser(t.Context(), owner.ID, ListFilter{Sort: "title", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, firstPage, 2)
+	assert.Equal(t, "Books", firstPage[0].Title)
+	assert.Equal(t, "Gifts", firstPage[1].Title)
+	assert.Nil(t, firstPage[0].Entries)
+	require.NotEmpty(t, cursor)
+
+	secondPage, cursor, err := store.GetListsForUser(t.Context(), owner.ID, ListFilter{Sort: "title", Limit: 2, Cursor: cursor, IncludeEntries: true})
+	require.NoError(t, err)
+	require.Len(t, secondPage, 2)
+	assert.Equal(t, "Groceries", secondPage[0].Title)
+	assert.Len(t, secondPage[0].Entries, 1)
+	assert.Equal(t, "Shared", secondPage[1].Title, "lists shared with the user are included")
+	assert.Empty(t, cursor)
+
+	filtered, _, err := store.GetListsForUser(t.Context(), owner.ID, ListFilter{Sort: "created_at", Descending: true, Limit: 10, Title: "g"})
+	require.NoError(t, err)
+	require.Len(t, filtered, 2)
+	assert.Equal(t, "Gifts", filtered[0].Title)
+
+	_, _, err = store.GetListsForUser(t.Context(), owner.ID, ListFilter{Sort: "title", Limit: 10, Cursor: "not-a-cursor"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestListEntryLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+
+	list, err := store.CreateList(t.Context(), &List{
+		Title:   "Chores",
+		UserID:  owner.ID,
+		Entries: []ListEntry{{Title: "Dishes", OrderIndex: 0}},
+	})
+	require.NoError(t, err)
+	require.NotZero(t, list.Entries[0].ID)
+	listID := int64(list.ID)
+
+	entry := &ListEntry{Title: "Laundry", OrderIndex: 1}
+	require.NoError(t, store.CreateListEntry(t.Context(), listID, entry, owner.ID))
+	require.NotZero(t, entry.ID)
+
+	entry.Title = "Fold laundry"
+	require.NoError(t, store.UpdateListEntry(t.Context(), listID, entry, owner.ID))
+
+	retrieved, err := store.GetListEntry(t.Context(), listID, int64(entry.ID))
+	require.NoError(t, err)
+	assert.Equal(t, entry.ID, retrieved.ID)
+	assert.Equal(t, "Fold laundry", retrieved.Title)
+
+	require.NoError(t, store.DeleteListEntry(t.Context(), listID, int64(entry.ID), owner.ID))
+	assert.ErrorIs(t, store.DeleteListEntry(t.Context(), listID, int64(entry.ID), owner.ID), sql.ErrNoRows)
+
+	missing, err := store.GetListEntry(t.Context(), listID, int64(entry.ID))
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	unchanged, err := store.GetListByID(t.Context(), listID)
+	require.NoError(t, err)
+	require.Len(t, unchanged.Entries, 1)
+	assert.Equal(t, list.Entries[0].ID, unchanged.Entries[0].ID)
+}
+
+func TestReorderListEntries(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+
+	list, err := store.CreateList(t.Context(), &List{
+		Title:  "Steps",
+		UserID: owner.ID,
+		Entries: []ListEntry{
+			{Title: "a", OrderIndex: 0},
+			{Title: "b", OrderIndex: 0},
+			{Title: "c", OrderIndex: 5},
+		},
+	})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+
+	a, b, c := int64(list.Entries[0].ID), int64(list.Entries[1].ID), int64(list.Entries[2].ID)
+
+	entries, err := store.ReorderListEntries(t.Context(), listID, []int64{c, a, b}, owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "a", "b"}, entryTitles(entries))
+
+	_, err = store.ReorderListEntries(t.Context(), listID, []int64{c, a}, owner.ID)
+	assert.ErrorIs(t, err, ErrInvalidEntryOrder)
+
+	entries, err = store.MoveListEntry(t.Context(), listID, c, b, true, owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, entryTitles(entries))
+
+	require.NoError(t, store.DeleteListEntry(t.Context(), listID, a, owner.ID))
+
+	retrieved, err := store.GetListByID(t.Context(), listID)
+	require.NoError(t, err)
+	for i, entry := range retrieved.Entries {
+		assert.Equal(t, i, entry.OrderIndex)
+	}
+}
+
+func entryTitles(entries []ListEntry) []string {
+	titles := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		titles = append(titles, entry.Title)
+	}
+	return titles
+}
+
+func TestListEntryCompletion(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+
+	due := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	list, err := store.CreateList(t.Context(), &List{
+		Title:  "Todo",
+		UserID: owner.ID,
+		Entries: []ListEntry{
+			{Title: "low", Priority: PriorityLow},
+			{Title: "high", Priority: PriorityHigh, DueAt: &due},
+			{Title: "done", Completed: true},
+		},
+	})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+	assert.NotNil(t, list.Entries[2].CompletedAt)
+
+	entry := list.Entries[0]
+	entry.Completed = true
+	require.NoError(t, store.UpdateListEntry(t.Context(), listID, &entry, owner.ID))
+	require.NotNil(t, entry.CompletedAt)
+
+	entry.Completed = false
+	require.NoError(t, store.UpdateListEntry(t.Context(), listID, &entry, owner.ID))
+	assert.Nil(t, entry.CompletedAt)
+
+	open := false
+	filtered, err := store.GetFilteredListByID(t.Context(), listID, EntryFilter{Completed: &open, Sort: "priority", Descending: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"high", "low"}, entryTitles(filtered.Entries))
+
+	byDue, err := store.GetFilteredListByID(t.Context(), listID, EntryFilter{Sort: "due_at"})
+	require.NoError(t, err)
+	assert.Equal(t, "high", byDue.Entries[0].Title)
+	assert.True(t, due.Equal(*byDue.Entries[0].DueAt))
+}
+
+func TestListMembers(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+	friend := createTestUser(t, db, "friend")
+
+	list, err := store.CreateList(t.Context(), &List{Title: "Shared", UserID: owner.ID})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+
+	role, err := store.GetListRole(t.Context(), listID, owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, RoleOwner, role)
+
+	role, err = store.GetListRole(t.Context(), listID, friend.ID)
+	require.NoError(t, err)
+	assert.Empty(t, role)
+
+	require.NoError(t, store.AddListMember(t.Context(), listID, friend.ID, RoleViewer))
+	assert.ErrorIs(t, store.AddListMember(t.Context(), listID, friend.ID, RoleEditor), ErrAlreadyMember)
+
+	require.NoError(t, store.UpdateListMemberRole(t.Context(), listID, friend.ID, RoleEditor))
+	role, err = store.GetListRole(t.Context(), listID, friend.ID)
+	require.NoError(t, err)
+	assert.True(t, RoleAllows(role, RoleEditor))
+	assert.False(t, RoleAllows(role, RoleOwner))
+
+	assert.ErrorIs(t, store.UpdateListMemberRole(t.Context(), listID, owner.ID, RoleViewer), ErrLastOwner)
+	assert.ErrorIs(t, store.RemoveListMember(t.Context(), listID, owner.ID), ErrLastOwner)
+
+	members, err := store.GetListMembers(t.Context(), listID)
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	require.NoError(t, store.RemoveListMember(t.Context(), listID, friend.ID))
+
+	_, err = store.GetListRole(t.Context(), listID+1000, owner.ID)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestListVisibility(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+	stranger := createTestUser(t, db, "stranger")
+
+	list, err := store.CreateList(t.Context(), &List{Title: "Reading", UserID: owner.ID})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+	assert.Equal(t, VisibilityPrivate, list.Visibility)
+	require.NotEmpty(t, list.Slug)
+
+	role, err := store.GetListRole(t.Context(), listID, stranger.ID)
+	require.NoError(t, err)
+	assert.Empty(t, role)
+
+	list.Visibility = VisibilityPublic
+	require.NoError(t, store.UpdateList(t.Context(), list, owner.ID))
+
+	role, err = store.GetListRole(t.Context(), listID, stranger.ID)
+	require.NoError(t, err)
+	assert.Equal(t, RolePublic, role)
+	assert.True(t, RoleAllows(role, RolePublic))
+	assert.False(t, RoleAllows(role, RoleViewer), "members and history stay private")
+	assert.True(t, RoleAllows(RoleViewer, RolePublic))
+	assert.False(t, ValidRole(RolePublic))
+
+	bySlug, err := store.GetListBySlug(t.Context(), list.Slug)
+	require.NoError(t, err)
+	assert.Equal(t, list.ID, bySlug.ID)
+
+	missing, err := store.GetListBySlug(t.Context(), "does-not-exist")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestListTrash(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+	friend := createTestUser(t, db, "friend")
+
+	list, err := store.CreateList(t.Context(), &List{Title: "Old", UserID: owner.ID})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+	require.NoError(t, store.AddListMember(t.Context(), listID, friend.ID, RoleEditor))
+
+	assert.ErrorIs(t, store.DeleteList(t.Context(), listID, list.Version+1), ErrEditConflict)
+	require.NoError(t, store.DeleteList(t.Context(), listID, list.Version))
+	assert.ErrorIs(t, store.DeleteList(t.Context(), listID, 0), sql.ErrNoRows)
+
+	gone, err := store.GetListByID(t.Context(), listID)
+	require.NoError(t, err)
+	assert.Nil(t, gone)
+
+	trashed, err := store.GetTrashedLists(t.Context(), owner.ID)
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	assert.NotNil(t, trashed[0].DeletedAt)
+
+	assert.ErrorIs(t, store.RestoreList(t.Context(), listID, friend.ID), sql.ErrNoRows)
+	require.NoError(t, store.RestoreList(t.Context(), listID, owner.ID))
+
+	restored, err := store.GetListByID(t.Context(), listID)
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+
+	require.NoError(t, store.DeleteList(t.Context(), listID, 0))
+
+	purged, err := store.PurgeDeletedLists(t.Context(), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+
+	purged, err = store.PurgeDeletedLists(t.Context(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+}
+
+func TestListRevisions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+
+	list, err := store.CreateList(t.Context(), &List{
+		Title:   "Packing",
+		UserID:  owner.ID,
+		Entries: []ListEntry{{Title: "Passport"}, {Title: "Charger"}},
+	})
+	require.NoError(t, err)
+	listID := int64(list.ID)
+	passportID := list.Entries[0].ID
+
+	list.Title = "Packing for Lisbon"
+	list.Entries = []ListEntry{{ID: passportID, Title: "Passport"}, {Title: "Sunscreen"}}
+	require.NoError(t, store.UpdateList(t.Context(), list, owner.ID))
+	assert.Equal(t, passportID, list.Entries[0].ID)
+
+	revisions, err := store.GetListRevisions(t.Context(), listID)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 2, revisions[0].Revision)
+	assert.Equal(t, owner.ID, *revisions[0].AuthorID)
+
+	first, err := store.GetListRevision(t.Context(), listID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Packing", first.Title)
+	assert.Equal(t, []string{"Passport", "Charger"}, entryTitles(first.Entries))
+
+	second, err := store.GetListRevision(t.Context(), listID, 2)
+	require.NoError(t, err)
+
+	diff := DiffRevisions(first, second)
+	assert.NotNil(t, diff.Title)
+	assert.Len(t, diff.EntriesAdded, 1)
+	assert.Len(t, diff.EntriesRemoved, 1)
+
+	missing, err := store.GetListRevision(t.Context(), listID, 3)
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	require.NoError(t, store.CreateListEntry(t.Context(), listID, &ListEntry{Title: "Adapter", OrderIndex: -1}, owner.ID))
+
+	third, err := store.GetListRevision(t.Context(), listID, 3)
+	require.NoError(t, err)
+	require.NotNil(t, third)
+	assert.Equal(t, owner.ID, *third.AuthorID)
+	assert.Equal(t, []string{"Passport", "Sunscreen", "Adapter"}, entryTitles(third.Entries))
+}
+
+func TestUpdateListVersionConflict(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, testQueryTimeout)
+	owner := createTestUser(t, db, "owner")
+
+	list, err := store.CreateList(t.Context(), &List{Title: "Versioned", UserID: owner.ID})
+	require.NoError(t, err)
+	assert.Equal(t, 1, list.Version)
+
+	stale := *list
+
+	list.Title = "First edit"
+	require.NoError(t, store.UpdateList(t.Context(), list, owner.ID))
+	assert.Equal(t, 2, list.Version)
+
+	stale.Title = "Second edit"
+	assert.ErrorIs(t, store.UpdateList(t.Context(), &stale, owner.ID), ErrEditConflict)
+
+	require.NoError(t, store.CreateListEntry(t.Context(), int64(list.ID), &ListEntry{Title: "Entry", OrderIndex: -1}, owner.ID))
+
+	retrieved, err := store.GetListByID(t.Context(), int64(list.ID))
+	require.NoError(t, err)
+	assert.Equal(t, 3, retrieved.Version)
+}
+
+func TestTokenSessions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "sessions")
+
+	first, err := tokens.GenerateToken(user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+	first.UserAgent = "curl/8.0"
+	first.IP = "127.0.0.1"
+	require.NoError(t, tokenStore.Insert(t.Context(), first))
+
+	second, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	authenticated, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, first.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, authenticated)
+	assert.Equal(t, user.ID, authenticated.ID)
+
+	sessions, err := tokenStore.GetSessionsForUser(t.Context(), user.ID, tokens.ScopeAuth, first.Hash)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.True(t, sessions[0].Current)
+	assert.NotNil(t, sessions[0].LastUsedAt)
+	assert.Equal(t, "curl/8.0", sessions[0].UserAgent)
+	assert.Equal(t, "127.0.0.1", sessions[0].IP)
+	assert.False(t, sessions[1].Current)
+
+	require.NoError(t, tokenStore.DeleteToken(t.Context(), first.Hash))
+	assert.ErrorIs(t, tokenStore.DeleteToken(t.Context(), first.Hash), sql.ErrNoRows)
+
+	revoked, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, first.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, revoked)
+
+	other := createTestUser(t, db, "other")
+	assert.ErrorIs(t, tokenStore.DeleteTokenForUser(t.Context(), sessions[1].ID, other.ID, tokens.ScopeAuth), sql.ErrNoRows)
+	require.NoError(t, tokenStore.DeleteTokenForUser(t.Context(), sessions[1].ID, user.ID, tokens.ScopeAuth))
+
+	revokedSecond, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, second.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, revokedSecond)
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "refresh")
+
+	family, err := tokens.NewFamily()
+	require.NoError(t, err)
+
+	access, refresh, err := tokens.GeneratePair(user.ID, family, time.Minute, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, tokenStore.InsertPair(t.Context(), access, refresh))
+
+	_, _, err = tokenStore.RotateRefreshToken(t.Context(), access.Plaintext, time.Minute, time.Hour, "", "")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	newAccess, newRefresh, err := tokenStore.RotateRefreshToken(t.Context(), refresh.Plaintext, time.Minute, time.Hour, "agent", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, family, newRefresh.Family)
+	assert.NotEqual(t, refresh.Plaintext, newRefresh.Plaintext)
+
+	authenticated, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, newAccess.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, authenticated)
+
+	_, _, err = tokenStore.RotateRefreshToken(t.Context(), refresh.Plaintext, time.Minute, time.Hour, "", "")
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	for _, plaintext := range []string{access.Plaintext, newAccess.Plaintext} {
+		revoked, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, plaintext)
+		require.NoError(t, err)
+		assert.Nil(t, revoked)
+	}
+
+	_, _, err = tokenStore.RotateRefreshToken(t.Context(), newRefresh.Plaintext, time.Minute, time.Hour, "", "")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestSessionsGroupRefreshedTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "refreshing")
+
+	family, err := tokens.NewFamily()
+	require.NoError(t, err)
+
+	access, refresh, err := tokens.GeneratePair(user.ID, family, time.Minute, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, tokenStore.InsertPair(t.Context(), access, refresh))
+
+	newAccess, _, err := tokenStore.RotateRefreshToken(t.Context(), refresh.Plaintext, time.Minute, time.Hour, "agent", "10.0.0.1")
+	require.NoError(t, err)
+
+	other, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	sessions, err := tokenStore.GetSessionsForUser(t.Context(), user.ID, tokens.ScopeAuth, access.Hash)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	var refreshed Session
+	for _, session := range sessions {
+		if session.Current {
+			refreshed = session
+		}
+	}
+	assert.Equal(t, "agent", refreshed.UserAgent)
+
+	require.NoError(t, tokenStore.DeleteTokenForUser(t.Context(), refreshed.ID, user.ID, tokens.ScopeAuth))
+
+	for _, plaintext := range []string{access.Plaintext, newAccess.Plaintext} {
+		revoked, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, plaintext)
+		require.NoError(t, err)
+		assert.Nil(t, revoked)
+	}
+
+	sessions, err = tokenStore.GetSessionsForUser(t.Context(), user.ID, tokens.ScopeAuth, other.Hash)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Current)
+}
+
+func TestPersonalTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "automation")
+
+	ci := &PersonalToken{Name: "ci", Scopes: []string{tokens.PermissionListsRead, tokens.PermissionListsWrite}}
+	require.NoError(t, tokenStore.CreatePersonalToken(t.Context(), user.ID, ci))
+	assert.NotEmpty(t, ci.Token)
+
+	expiresAt := time.Now().Add(time.Hour)
+	script := &PersonalToken{Name: "script", Scopes: []string{tokens.PermissionListsRead}, ExpiresAt: &expiresAt}
+	require.NoError(t, tokenStore.CreatePersonalToken(t.Context(), user.ID, script))
+
+	authenticated, permissions, err := userStore.GetUserByAccessToken(t.Context(), ci.Token)
+	require.NoError(t, err)
+	require.NotNil(t, authenticated)
+	assert.Equal(t, user.ID, authenticated.ID)
+	assert.Equal(t, []string{tokens.PermissionListsRead, tokens.PermissionListsWrite}, permissions)
+
+	session, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	_, permissions, err = userStore.GetUserByAccessToken(t.Context(), session.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, permissions)
+
+	personalTokens, err := tokenStore.GetPersonalTokensForUser(t.Context(), user.ID)
+	require.NoError(t, err)
+	require.Len(t, personalTokens, 2)
+	assert.Equal(t, "script", personalTokens[0].Name)
+	assert.NotNil(t, personalTokens[0].ExpiresAt)
+	assert.Empty(t, personalTokens[0].Token)
+	assert.Equal(t, "ci", personalTokens[1].Name)
+	assert.Nil(t, personalTokens[1].ExpiresAt)
+	assert.NotNil(t, personalTokens[1].LastUsedAt)
+
+	require.NoError(t, tokenStore.DeleteTokenForUser(t.Context(), ci.ID, user.ID, tokens.ScopePersonal))
+
+	revoked, _, err := userStore.GetUserByAccessToken(t.Context(), ci.Token)
+	require.NoError(t, err)
+	assert.Nil(t, revoked)
+}
+
+func TestUpdatePasswordRevokesTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "forgetful")
+
+	found, err := userStore.GetUserByEmail(t.Context(), "forgetful@example.com")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, user.ID, found.ID)
+
+	session, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	reset, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopePasswordReset)
+	require.NoError(t, err)
+
+	resetting, err := userStore.GetUserToken(t.Context(), tokens.ScopePasswordReset, reset.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, resetting)
+
+	require.NoError(t, userStore.SetPassword(resetting, "new-password"))
+	require.NoError(t, userStore.UpdatePassword(t.Context(), resetting))
+
+	updated, err := userStore.GetUserByUsername(t.Context(), "forgetful")
+	require.NoError(t, err)
+	matches, err := userStore.PasswordMatches(updated, "new-password")
+	require.NoError(t, err)
+	assert.True(t, matches)
+
+	for scope, plaintext := range map[string]string{tokens.ScopeAuth: session.Plaintext, tokens.ScopePasswordReset: reset.Plaintext} {
+		revoked, err := userStore.GetUserToken(t.Context(), scope, plaintext)
+		require.NoError(t, err)
+		assert.Nil(t, revoked)
+	}
+}
+
+func TestSigningOutRevokesJWTs(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	revokedStore := NewPostgresRevokedTokenStore(db, testQueryTimeout)
+	user := createTestUser(t, db, "stolen")
+
+	jti := func(token *tokens.Token) string {
+		return base64.RawURLEncoding.EncodeToString(token.Hash)
+	}
+
+	first, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+	require.NoError(t, tokenStore.DeleteAllTokensForUser(t.Context(), user.ID, tokens.ScopeAuth))
+
+	second, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+	require.NoError(t, userStore.DeleteUser(t.Context(), user.ID))
+
+	revoked, err := revokedStore.GetRevoked(t.Context())
+	require.NoError(t, err)
+	assert.Contains(t, revoked, jti(first))
+	assert.Contains(t, revoked, jti(second))
+	assert.WithinDuration(t, first.Expiry, revoked[jti(first)], time.Second)
+}
+
+func TestRehashPasswordKeepsTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, passwords.NewManager(passwords.Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}), testQueryTimeout)
+	user := createTestUser(t, db, "legacy")
+
+	session, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	assert.True(t, userStore.PasswordNeedsRehash(user))
+	require.NoError(t, userStore.SetPassword(user, "password"))
+	require.NoError(t, userStore.RehashPassword(t.Context(), user))
+
+	updated, err := userStore.GetUserByUsername(t.Context(), "legacy")
+	require.NoError(t, err)
+	assert.False(t, userStore.PasswordNeedsRehash(updated))
+	matches, err := userStore.PasswordMatches(updated, "password")
+	require.NoError(t, err)
+	assert.True(t, matches)
+
+	stillSignedIn, err := userStore.GetUserToken(t.Context(), tokens.ScopeAuth, session.Plaintext)
+	require.NoError(t, err)
+	assert.NotNil(t, stillSignedIn)
+}
+
+func TestActivateUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "newcomer")
+	assert.False(t, user.Activated)
+
+	lastSent, err := tokenStore.GetLatestTokenCreatedAt(t.Context(), user.ID, tokens.ScopeActivation)
+	require.NoError(t, err)
+	assert.Nil(t, lastSent)
+
+	token, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Hour, tokens.ScopeActivation)
+	require.NoError(t, err)
+
+	lastSent, err = tokenStore.GetLatestTokenCreatedAt(t.Context(), user.ID, tokens.ScopeActivation)
+	require.NoError(t, err)
+	require.NotNil(t, lastSent)
+
+	activating, err := userStore.GetUserToken(t.Context(), tokens.ScopeActivation, token.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, activating)
+
+	require.NoError(t, userStore.ActivateUser(t.Context(), activating))
+	assert.True(t, activating.Activated)
+
+	retrieved, err := userStore.GetUserByUsername(t.Context(), "newcomer")
+	require.NoError(t, err)
+	assert.True(t, retrieved.Activated)
+
+	used, err := userStore.GetUserToken(t.Context(), tokens.ScopeActivation, token.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, used)
+}
+
+func TestConsumeUserToken(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "verifying")
+
+	token, err := tokenStore.CreateNewToken(t.Context(), user.ID, time.Minute, tokens.ScopeMFAPending)
+	require.NoError(t, err)
+
+	wrongScope, err := userStore.ConsumeUserToken(t.Context(), tokens.ScopeAuth, token.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, wrongScope)
+
+	consumed, err := userStore.ConsumeUserToken(t.Context(), tokens.ScopeMFAPending, token.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, consumed)
+	assert.Equal(t, user.ID, consumed.ID)
+
+	again, err := userStore.ConsumeUserToken(t.Context(), tokens.ScopeMFAPending, token.Plaintext)
+	require.NoError(t, err)
+	assert.Nil(t, again)
+}
+
+func TestCreateUserWithActivationToken(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := &User{Username: "registering", Email: "registering@example.com"}
+	require.NoError(t, userStore.SetPassword(user, "password123"))
+
+	token, err := userStore.CreateUserWithActivationToken(t.Context(), user, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, token.UserID)
+
+	activating, err := userStore.GetUserToken(t.Context(), tokens.ScopeActivation, token.Plaintext)
+	require.NoError(t, err)
+	require.NotNil(t, activating)
+	assert.Equal(t, user.ID, activating.ID)
+
+	duplicate := &User{Username: "registering", Email: "other@example.com"}
+	require.NoError(t, userStore.SetPassword(duplicate, "password123"))
+	_, err = userStore.CreateUserWithActivationToken(t.Context(), duplicate, time.Hour)
+	assert.ErrorIs(t, err, ErrDuplicateUsername)
+}
+
+func TestUpdateAndDeleteUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	listStore := NewPostgresListStore(db, testQueryTimeout)
+	tokenStore := NewPostgresTokenStore(db, testQueryTimeout)
+
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	alice.Username = "bob"
+	assert.ErrorIs(t, userStore.UpdateUser(t.Context(), alice), ErrDuplicateUsername)
+
+	alice.Username = "alice"
+	alice.Email = "bob@example.com"
+	assert.ErrorIs(t, userStore.UpdateUser(t.Context(), alice), ErrDuplicateEmail)
+
+	alice.Email = "alice@example.org"
+	require.NoError(t, userStore.UpdateUser(t.Context(), alice))
+
+	retrieved, err := userStore.GetUserByEmail(t.Context(), "alice@example.org")
+	require.NoError(t, err)
+	require.NotNil(t, retrieved)
+	assert.Equal(t, alice.ID, retrieved.ID)
+
+	list, err := listStore.CreateList(t.Context(), &List{
+		Title:   "Alice's list",
+		UserID:  alice.ID,
+		Entries: []ListEntry{{Title: "Entry"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, listStore.AddListMember(t.Context(), int64(list.ID), bob.ID, RoleEditor))
+
+	coOwned, err := listStore.CreateList(t.Context(), &List{Title: "Co-owned", UserID: alice.ID})
+	require.NoError(t, err)
+	require.NoError(t, listStore.AddListMember(t.Context(), int64(coOwned.ID), bob.ID, RoleOwner))
+
+	handedOver, err := listStore.CreateList(t.Context(), &List{Title: "Handed over", UserID: bob.ID})
+	require.NoError(t, err)
+	require.NoError(t, listStore.AddListMember(t.Context(), int64(handedOver.ID), alice.ID, RoleOwner))
+	require.NoError(t, listStore.UpdateListMemberRole(t.Context(), int64(handedOver.ID), bob.ID, RoleViewer))
+
+	_, err = tokenStore.CreateNewToken(t.Context(), alice.ID, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	require.NoError(t, userStore.DeleteUser(t.Context(), alice.ID))
+	assert.ErrorIs(t, userStore.DeleteUser(t.Context(), alice.ID), sql.ErrNoRows)
+
+	for _, id := range []int{list.ID, handedOver.ID} {
+		deleted, err := listStore.GetListByID(t.Context(), int64(id))
+		require.NoError(t, err)
+		assert.Nil(t, deleted, "lists alice was the only owner of are deleted")
+	}
+
+	kept, err := listStore.GetListByID(t.Context(), int64(coOwned.ID))
+	require.NoError(t, err)
+	require.NotNil(t, kept, "lists with another owner are kept")
+	assert.Equal(t, bob.ID, kept.UserID)
+
+	var remainingTokens int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE user_id = $1`, alice.ID).Scan(&remainingTokens))
+	assert.Zero(t, remainingTokens)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "twofactor")
+
+	settings, err := userStore.GetTOTP(t.Context(), user.ID)
+	require.NoError(t, err)
+	assert.False(t, settings.Enabled)
+	assert.Nil(t, settings.Secret)
+
+	assert.ErrorIs(t, userStore.EnableTOTP(t.Context(), user.ID, 100, nil), sql.ErrNoRows)
+
+	require.NoError(t, userStore.StartTOTPEnrollment(t.Context(), user.ID, "SECRET"))
+
+	recoveryHash := tokens.Hash("abcde-fghij")
+	require.NoError(t, userStore.EnableTOTP(t.Context(), user.ID, 100, [][]byte{recoveryHash}))
+	assert.ErrorIs(t, userStore.StartTOTPEnrollment(t.Context(), user.ID, "OTHER"), sql.ErrNoRows)
+
+	settings, err = userStore.GetTOTP(t.Context(), user.ID)
+	require.NoError(t, err)
+	assert.True(t, settings.Enabled)
+	require.NotNil(t, settings.Secret)
+	assert.Equal(t, "SECRET", *settings.Secret)
+
+	accepted, err := userStore.RecordTOTPStep(t.Context(), user.ID, 100)
+	require.NoError(t, err)
+	assert.False(t, accepted, "the confirming code cannot be reused")
+
+	accepted, err = userStore.RecordTOTPStep(t.Context(), user.ID, 101)
+	require.NoError(t, err)
+	assert.True(t, accepted)
+
+	used, err := userStore.UseRecoveryCode(t.Context(), user.ID, recoveryHash)
+	require.NoError(t, err)
+	assert.True(t, used)
+
+	used, err = userStore.UseRecoveryCode(t.Context(), user.ID, recoveryHash)
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, userStore.DisableTOTP(t.Context(), user.ID))
+
+	settings, err = userStore.GetTOTP(t.Context(), user.ID)
+	require.NoError(t, err)
+	assert.False(t, settings.Enabled)
+	assert.Nil(t, settings.Secret)
+}
+
+func TestLoginAttempts(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	attempts := NewPostgresLoginAttemptStore(db, testQueryTimeout)
+	policy := LoginPolicy{FreeAttempts: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+	keys := []string{"username:alice", "ip:127.0.0.1"}
+
+	lockedUntil, err := attempts.RecordFailure(t.Context(), "username:alice", policy)
+	require.NoError(t, err)
+	assert.Nil(t, lockedUntil)
+
+	lockedUntil, err = attempts.GetLockedUntil(t.Context(), keys)
+	require.NoError(t, err)
+	assert.Nil(t, lockedUntil)
+
+	lockedUntil, err = attempts.RecordFailure(t.Context(), "username:alice", policy)
+	require.NoError(t, err)
+	require.NotNil(t, lockedUntil)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *lockedUntil, 5*time.Second)
+
+	lockedUntil, err = attempts.RecordFailure(t.Context(), "username:alice", policy)
+	require.NoError(t, err)
+	require.NotNil(t, lockedUntil)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), *lockedUntil, 5*time.Second)
+
+	lockedUntil, err = attempts.GetLockedUntil(t.Context(), keys)
+	require.NoError(t, err)
+	require.NotNil(t, lockedUntil)
+
+	lockouts, err := attempts.GetLockouts(t.Context())
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1)
+	assert.Equal(t, "username:alice", lockouts[0].Key)
+	assert.Equal(t, 3, lockouts[0].Failures)
+
+	require.NoError(t, attempts.ResetAttempts(t.Context(), "username:alice"))
+	assert.ErrorIs(t, attempts.ResetAttempts(t.Context(), "username:alice"), sql.ErrNoRows)
+
+	lockedUntil, err = attempts.GetLockedUntil(t.Context(), keys)
+	require.NoError(t, err)
+	assert.Nil(t, lockedUntil)
+}
+
+func TestRevokedTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresRevokedTokenStore(db, testQueryTimeout)
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	require.NoError(t, store.Revoke(t.Context(), "current", expiry))
+	require.NoError(t, store.Revoke(t.Context(), "current", expiry), "revoking twice is fine")
+	require.NoError(t, store.Revoke(t.Context(), "expired", time.Now().Add(-time.Minute)))
+
+	revoked, err := store.GetRevoked(t.Context())
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	assert.True(t, revoked["current"].Equal(expiry))
+
+	require.NoError(t, store.DeleteExpired(t.Context()))
+
+	var remaining int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens`).Scan(&remaining))
+	assert.Equal(t, 1, remaining)
+}
+
+func TestGetUserByID(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userStore := NewPostgresUserStore(db, testPasswords, testQueryTimeout)
+	user := createTestUser(t, db, "byid")
+
+	found, err := userStore.GetUserByID(t.Context(), user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "byid", found.Username)
+
+	missing, err := userStore.GetUserByID(t.Context(), user.ID+1000)
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := NewPostgresListStore(db, time.Nanosecond)
+
+	_, err := store.GetListByID(t.Context(), 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	store = NewPostgresListStore(db, 0)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err = store.GetListByID(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -4,19 +4,112 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"strings"
 	"time"
 )
 
 const (
-	ScopeAuth = "authentication"
+	ScopeAuth          = "authentication"
+	ScopeRefresh       = "refresh"
+	ScopePersonal      = "personal"
+	ScopePasswordReset = "password-reset"
+	ScopeActivation    = "activation"
+	ScopeMFAPending    = "mfa-pending"
 )
 
+// Permissions limit what a personal access token may be used for. Session
+// tokens carry no permissions and are not limited.
+const (
+	PermissionListsRead     = "lists:read"
+	PermissionListsWrite    = "lists:write"
+	PermissionAccountManage = "account:manage"
+)
+
+var permissions = map[string]bool{
+	PermissionListsRead:     true,
+	PermissionListsWrite:    true,
+	PermissionAccountManage: true,
+}
+
+// ValidPermission reports whether permission is one that can be granted to a
+// personal access token.
+func ValidPermission(permission string) bool {
+	return permissions[permission]
+}
+
+// HasPermission reports whether a token granted permissions may be used for
+// something that requires required. A nil slice means the token is not
+// limited.
+func HasPermission(granted []string, required string) bool {
+	if granted == nil {
+		return true
+	}
+
+	for _, permission := range granted {
+		if permission == required {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Token is an opaque bearer token. Tokens issued from the same login share a
+// Family, so a whole refresh chain can be revoked at once.
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int       `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// Hash returns the SHA-256 hash under which a plaintext token is stored.
+func Hash(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+func randomString() (string, error) {
+	emptyBytes := make([]byte, 32)
+	_, err := rand.Read(emptyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes), nil
+}
+
+// NewFamily returns a random identifier for a new token family.
+func NewFamily() (string, error) {
+	return randomString()
+}
+
+// GenerateRecoveryCode returns a random two-factor recovery code formatted
+// for people to copy, such as "k3x7p-q2m9d".
+func GenerateRecoveryCode() (string, error) {
+	emptyBytes := make([]byte, 10)
+	_, err := rand.Read(emptyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes))
+	return code[:5] + "-" + code[5:10], nil
+}
+
+// NormaliseRecoveryCode undoes formatting a user may have added or removed
+// when typing a recovery code, so it can be hashed and compared.
+func NormaliseRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	if len(code) != 10 {
+		return code
+	}
+
+	return code[:5] + "-" + code[5:]
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -26,15 +119,32 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 		Scope:  scope,
 	}
 
-	emptyBytes := make([]byte, 32)
-	_, err := rand.Read(emptyBytes)
+	plaintext, err := randomString()
 	if err != nil {
 		return nil, err
 	}
 
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes)
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Plaintext = plaintext
+	token.Hash = Hash(token.Plaintext)
 
 	return token, nil
 }
+
+// GeneratePair returns an access token and a refresh token for userID that
+// belong to family.
+func GeneratePair(userID int, family string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	access, err := GenerateToken(userID, accessTTL, ScopeAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := GenerateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access.Family = family
+	refresh.Family = family
+
+	return access, refresh, nil
+}
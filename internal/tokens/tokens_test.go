@@ -0,0 +1,36 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateToken(t *testing.T) {
+	token, err := GenerateToken(1, time.Hour, ScopeAuth)
+	require.NoError(t, err)
+
+	assert.Len(t, token.Plaintext, 52)
+	assert.Equal(t, Hash(token.Plaintext), token.Hash)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Second)
+}
+
+func TestHasPermission(t *testing.T) {
+	assert.True(t, HasPermission(nil, PermissionAccountManage))
+	assert.True(t, HasPermission([]string{PermissionListsRead}, PermissionListsRead))
+	assert.False(t, HasPermission([]string{PermissionListsRead}, PermissionListsWrite))
+	assert.False(t, HasPermission([]string{}, PermissionListsRead))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+
+	assert.Equal(t, code, NormaliseRecoveryCode(code))
+	assert.Equal(t, "abcde-fghij", NormaliseRecoveryCode("ABCDEFGHIJ"))
+	assert.Equal(t, "abcde-fghij", NormaliseRecoveryCode(" abcde fghij "))
+	assert.Equal(t, "short", NormaliseRecoveryCode("short"))
+}
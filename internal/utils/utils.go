@@ -1,17 +1,36 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mikemcavoydev/list-api/internal/logging"
 )
 
 type Envelope map[string]interface{}
 
+// RequestIDHeader carries the ID of a request, so client reports can be
+// matched with the server's logs.
+const RequestIDHeader = "X-Request-ID"
+
+// WriteJSON writes data as the response body. Error envelopes also get the
+// request's ID when the response has one.
 func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
+	if _, ok := data["error"]; ok {
+		if id := w.Header().Get(RequestIDHeader); id != "" {
+			data = maps.Clone(data)
+			data["request_id"] = id
+		}
+	}
+
 	js, err := json.MarshalIndent(data, "", " ")
 	if err != nil {
 		return err
@@ -24,16 +43,90 @@ func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 	return nil
 }
 
+// StatusClientClosedRequest is the non-standard status nginx uses for
+// requests the client went away from before they were answered.
+const StatusClientClosedRequest = 499
+
+// ErrorStatus returns the status for a request that failed with err: 503 if
+// a query ran past its deadline, 499 if the client went away and 500
+// otherwise.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// WriteServerError responds to a request that failed with err, with the
+// status ErrorStatus picks. Internal errors are logged to the request's logger
+// under op and answered with message; the details of err are never sent to
+// the client.
+func WriteServerError(w http.ResponseWriter, r *http.Request, op string, err error, message string) {
+	logger := logging.FromContext(r.Context())
+
+	switch status := ErrorStatus(err); status {
+	case http.StatusServiceUnavailable:
+		logger.Warn("request timed out", "op", op, "error", err)
+		WriteJSON(w, status, Envelope{"error": "the server is busy, try again later"})
+	case StatusClientClosedRequest:
+		WriteJSON(w, status, Envelope{"error": "request cancelled"})
+	default:
+		logger.Error("request failed", "op", op, "error", err)
+		WriteJSON(w, status, Envelope{"error": message})
+	}
+}
+
 func ReadIDParam(r *http.Request) (int64, error) {
-	idParam := chi.URLParam(r, "id")
+	return ReadNamedIDParam(r, "id")
+}
+
+func ReadNamedIDParam(r *http.Request, name string) (int64, error) {
+	idParam := chi.URLParam(r, name)
 	if idParam == "" {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	id, err := strconv.ParseInt(idParam, 10, 64)
 	if err != nil {
-		return 0, errors.New("invalid id parameter type")
+		return 0, fmt.Errorf("invalid %s parameter type", name)
 	}
 
 	return id, nil
 }
+
+// ETag formats a resource version as a strong entity tag.
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// MatchesETag reports whether the comma separated entity tags in an If-Match
+// or If-None-Match header include etag. A "*" matches any tag. Weak tags only
+// match when weak is set, as If-None-Match allows and If-Match does not.
+func MatchesETag(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the host part of the request's remote address.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
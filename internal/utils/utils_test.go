@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mikemcavoydev/list-api/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesETag(t *testing.T) {
+	etag := ETag(3)
+
+	tests := []struct {
+		name   string
+		header string
+		weak   bool
+		want   bool
+	}{
+		{name: "exact", header: `"3"`, want: true},
+		{name: "different version", header: `"2"`, want: false},
+		{name: "list", header: `"1", "3"`, want: true},
+		{name: "wildcard", header: `*`, want: true},
+		{name: "weak tag strong comparison", header: `W/"3"`, want: false},
+		{name: "weak tag weak comparison", header: `W/"3"`, weak: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MatchesETag(tt.header, etag, tt.weak))
+		})
+	}
+}
+
+func TestWriteServerError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		logged  string
+		message string
+	}{
+		{"internal", errors.New("boom"), http.StatusInternalServerError, "level=ERROR msg=\"request failed\" op=getList error=boom", "failed to fetch list"},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "level=WARN msg=\"request timed out\" op=getList", "the server is busy, try again later"},
+		{"cancelled", context.Canceled, StatusClientClosedRequest, "", "request cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, nil))
+			req := httptest.NewRequest(http.MethodGet, "/lists/1", nil)
+			req = req.WithContext(logging.NewContext(req.Context(), logger))
+			rr := httptest.NewRecorder()
+
+			WriteServerError(rr, req, "getList", tt.err, "failed to fetch list")
+
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.message)
+			assert.NotContains(t, rr.Body.String(), "boom")
+			if tt.logged == "" {
+				assert.Empty(t, logs.String())
+			} else {
+				assert.Contains(t, logs.String(), tt.logged)
+			}
+		})
+	}
+}
+
+func TestWriteJSONRequestID(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rr.Header().Set(RequestIDHeader, "abc")
+
+	shared := Envelope{"error": "list not found"}
+	WriteJSON(rr, http.StatusNotFound, shared)
+	assert.Contains(t, rr.Body.String(), `"request_id": "abc"`)
+	assert.NotContains(t, shared, "request_id", "the caller's envelope is left alone")
+
+	rr = httptest.NewRecorder()
+	rr.Header().Set(RequestIDHeader, "abc")
+	WriteJSON(rr, http.StatusOK, Envelope{"list": "groceries"})
+	assert.NotContains(t, rr.Body.String(), "request_id")
+}
@@ -1,41 +1,120 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mikemcavoydev/list-api/internal/app"
+	"github.com/mikemcavoydev/list-api/internal/config"
+	"github.com/mikemcavoydev/list-api/internal/mailer"
 	"github.com/mikemcavoydev/list-api/internal/routes"
 )
 
 func main() {
-	var port int
-	flag.IntVar(&port, "port", 8080, "go backend server port")
-	flag.Parse()
+	os.Exit(run())
+}
 
-	app, err := app.NewApplication()
+// run serves requests until SIGINT or SIGTERM, then drains in-flight
+// requests and stops the background jobs. It returns the exit status: 0 after
+// a clean shutdown, 1 if the server failed and 2 for invalid configuration.
+func run() int {
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 2
+	}
+
+	var mail mailer.Mailer
+	switch {
+	case cfg.SMTP.Host != "":
+		mail = mailer.NewSMTPMailer(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Sender)
+	case cfg.SMTP.MailFile != "":
+		file, err := os.OpenFile(cfg.SMTP.MailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening mail file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+
+		mail = mailer.NewLogMailer(file)
+	default:
+		mail = mailer.NewLogMailer(os.Stdout)
+	}
+
+	app, err := app.NewApplication(cfg, mail)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "starting application: %v\n", err)
+		return 1
 	}
 
 	defer app.DB.Close()
 
+	slog.SetDefault(app.Logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app.StartWorkers(ctx)
+
 	r := routes.SetupRoutes(app)
 
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         fmt.Sprintf(":%d", cfg.Port),
 		Handler:      r,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  cfg.IdleTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	}
 
-	app.Logger.Printf("application running on port %d", port)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 
-	err = server.ListenAndServe()
+	app.Logger.Info("application running", "port", cfg.Port)
+
+	select {
+	case err = <-serverErr:
+		app.Logger.Error("server failed", "op", "listenAndServe", "error", err)
+		return 1
+	case <-ctx.Done():
+	}
+
+	// A second signal kills the process without waiting.
+	stop()
+
+	app.Logger.Info("shutting down, draining requests", "timeout", cfg.ShutdownTimeout)
+	app.Drain()
+	time.Sleep(cfg.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		app.Logger.Fatal(err)
+		app.Logger.Error("shutdown failed", "op", "shutdown", "error", err)
+		return 1
 	}
+
+	// Background work such as sending email gets what is left of the
+	// shutdown timeout.
+	err = app.WaitWorkers(shutdownCtx)
+	if err != nil {
+		app.Logger.Error("shutdown failed", "op", "waitWorkers", "error", err)
+		return 1
+	}
+
+	app.Logger.Info("shutdown complete")
+	return 0
 }
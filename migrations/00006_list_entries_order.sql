@@ -0,0 +1,62 @@
+-- +goose Up
+-- +goose StatementBegin
+UPDATE list_entries e SET order_index = o.position
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY list_id ORDER BY order_index, id) - 1 AS position
+    FROM list_entries
+) o
+WHERE e.id = o.id;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE list_entries
+ADD CONSTRAINT list_entries_order_index_check CHECK (order_index >= 0),
+ADD CONSTRAINT list_entries_list_id_order_index_key UNIQUE (list_id, order_index) DEFERRABLE INITIALLY DEFERRED;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION check_list_entries_contiguous() RETURNS TRIGGER AS $$
+DECLARE
+    target_list_id BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        target_list_id := OLD.list_id;
+    ELSE
+        target_list_id := NEW.list_id;
+    END IF;
+
+    IF EXISTS (
+        SELECT 1 FROM list_entries
+        WHERE list_id = target_list_id
+        HAVING COUNT(*) > 0 AND MAX(order_index) <> COUNT(*) - 1
+    ) THEN
+        RAISE EXCEPTION 'order_index of list % is not contiguous', target_list_id
+            USING ERRCODE = 'check_violation';
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE CONSTRAINT TRIGGER list_entries_contiguous_order
+AFTER INSERT OR UPDATE OR DELETE ON list_entries
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION check_list_entries_contiguous();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER list_entries_contiguous_order ON list_entries;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP FUNCTION check_list_entries_contiguous();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE list_entries
+DROP CONSTRAINT list_entries_list_id_order_index_key,
+DROP CONSTRAINT list_entries_order_index_check;
+-- +goose StatementEnd
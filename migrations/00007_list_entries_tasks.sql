@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE list_entries
+ADD COLUMN completed BOOLEAN NOT NULL DEFAULT FALSE,
+ADD COLUMN completed_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN due_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN priority SMALLINT NOT NULL DEFAULT 0 CHECK (priority BETWEEN 0 AND 3),
+ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE list_entries
+DROP COLUMN completed,
+DROP COLUMN completed_at,
+DROP COLUMN due_at,
+DROP COLUMN priority,
+DROP COLUMN notes;
+-- +goose StatementEnd
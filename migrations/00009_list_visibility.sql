@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE lists
+ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'unlisted', 'public')),
+ADD COLUMN slug TEXT NOT NULL UNIQUE DEFAULT replace(gen_random_uuid()::text, '-', '');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE lists
+DROP COLUMN visibility,
+DROP COLUMN slug;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+    ADD COLUMN family TEXT,
+    ADD COLUMN used_at TIMESTAMP WITH TIME ZONE;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS idx_tokens_family ON tokens (family);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_tokens_family;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE tokens
+    DROP COLUMN used_at,
+    DROP COLUMN family;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+    ADD COLUMN name TEXT,
+    ADD COLUMN permissions TEXT,
+    ALTER COLUMN expiry DROP NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM tokens WHERE expiry IS NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE tokens
+    ALTER COLUMN expiry SET NOT NULL,
+    DROP COLUMN permissions,
+    DROP COLUMN name;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+-- +goose StatementEnd
+
+-- Admins can unlock accounts. Grant it with UPDATE users SET admin = true.
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN admin BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN admin;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE login_attempts;
+-- +goose StatementEnd